@@ -12,6 +12,7 @@ create table users (
   id text primary key,              -- asana user gid
   name text not null,
   avatar_url text,
+  profile_visibility text not null default 'public', -- public | team | private
   created_at timestamptz default now()
 );
 
@@ -22,7 +23,21 @@ create table quests (
   difficulty text not null references difficulty_weights(difficulty),
   completed boolean not null default false,
   completed_by text references users(id),
-  completed_at timestamptz
+  completed_at timestamptz,
+  project_id text,                  -- asana project (board) the task was synced from
+  assignee_id text references users(id),
+  due_at timestamptz,               -- due_at, or the end of due_on
+  multiplier numeric not null default 1, -- due date modifiers fixed at completion
+  section text,                     -- asana section (board column)
+  state text                        -- backlog | available | in_progress | review | done
+);
+
+-- quests claimed from the board, gone once completed, released or reassigned
+create table if not exists quest_claims (
+  quest_id text primary key references quests(id) on delete cascade,
+  user_id text not null references users(id),
+  claimed_at timestamptz not null default now(),
+  expire_error text                 -- why expiry gave up, not retried while set
 );
 
 -- scores (materialized for fast leaderboard)
@@ -49,3 +64,66 @@ create table if not exists sessions (
   created_at timestamptz default now()
 );
 
+
+-- timeline of completions, rank-ups, badges, kudos and season events
+create table if not exists activity (
+  id bigserial primary key,
+  kind text not null,
+  user_id text not null references users(id),
+  quest_id text,
+  points numeric not null default 0,
+  detail jsonb not null default '{}',
+  created_at timestamptz not null default now()
+);
+create index if not exists activity_user_idx on activity(user_id, id desc);
+
+-- extra points on a quest, paid by the scoring engine when it completes
+create table if not exists bounties (
+  quest_id text primary key,        -- asana task gid
+  points numeric not null,
+  decay_per_day numeric not null default 0,
+  first_only boolean not null default false,
+  deadline timestamptz,
+  created_by text references users(id),
+  created_at timestamptz not null default now(),
+  awarded_to text references users(id),
+  awarded_at timestamptz
+);
+
+-- per board mapping of asana sections to quest states, unmapped names are guessed
+create table if not exists section_states (
+  project_id text not null,
+  section text not null,
+  state text not null,
+  primary key (project_id, section)
+);
+
+-- every state change seen by sync or the board, for cycle times
+create table if not exists quest_transitions (
+  id bigserial primary key,
+  quest_id text not null references quests(id) on delete cascade,
+  user_id text references users(id),
+  from_state text,
+  to_state text not null,
+  at timestamptz not null default now()
+);
+
+-- teams of players, the activity feed filters by them
+create table if not exists guilds (
+  id text primary key,
+  name text not null
+);
+create table if not exists guild_members (
+  guild_id text not null references guilds(id) on delete cascade,
+  user_id text not null references users(id) on delete cascade,
+  primary key (guild_id, user_id)
+);
+create index if not exists guild_members_user_idx on guild_members(user_id);
+
+-- asana webhook per project, the secret comes with the handshake
+create table if not exists asana_webhooks (
+  project_id text primary key,
+  webhook_gid text,
+  secret text,
+  requested_at timestamptz not null default now()
+);
@@ -1,7 +1,20 @@
 export const API_BASE = import.meta.env.VITE_API_BASE ?? 'http://localhost:8080';
 
-export async function getLeaderboard(fetchFn = fetch) {
-  const res = await fetchFn(`/api/leaderboard`, { credentials: 'include' });
+//window: week | month | all, rank: competition | dense
+export async function getLeaderboard(fetchFn = fetch, { window, rank, limit, offset } = {}) {
+  const q = new URLSearchParams();
+  if (window) q.set('window', window);
+  if (rank) q.set('rank', rank);
+  if (limit) q.set('limit', limit);
+  if (offset) q.set('offset', offset);
+  const res = await fetchFn(`/api/leaderboard?${q}`, { credentials: 'include' });
+  if (!res.ok) throw new Error('failed to load leaderboard');
+  return res.json();
+}
+
+//{ me, around } with n players above and below the caller
+export async function getLeaderboardAroundMe(n = 3, fetchFn = fetch) {
+  const res = await fetchFn(`/api/leaderboard/me?n=${n}`, { credentials: 'include' });
   if (!res.ok) throw new Error('failed to load leaderboard');
   return res.json();
 }
@@ -35,3 +48,69 @@ export async function syncMe(fetchFn = fetch) {
 }
 
 
+
+export async function getActivity({ user, guild, kind, before, limit } = {}, fetchFn = fetch) {
+	const q = new URLSearchParams();
+	if (user) q.set('user', user);
+	if (guild) q.set('guild', guild);
+	if (kind) q.set('kind', kind);
+	if (before) q.set('before', before);
+	if (limit) q.set('limit', limit);
+	const res = await fetchFn(`/api/activity?${q}`, { credentials:'include' });
+	if (!res.ok) throw new Error('failed to load activity');
+	//{ items, next_before }
+	return res.json();
+}
+
+//live leaderboard/quest/badge events, returns a function that closes the stream
+export function subscribeEvents(handlers = {}) {
+	const es = new EventSource(`/api/events`, { withCredentials: true });
+	for (const [kind, fn] of Object.entries(handlers)) {
+		es.addEventListener(kind, (e) => fn(JSON.parse(e.data)));
+	}
+	return () => es.close();
+}
+
+export async function getUserProfile(userId, fetchFn = fetch) {
+	const res = await fetchFn(`/api/users/${userId}`, { credentials:'include' });
+	if (!res.ok) throw new Error('profile not found');
+	return res.json();
+}
+
+//visibility: public | team | private
+export async function setPrivacy(visibility) {
+	const res = await fetch(`/api/me/privacy`, {
+		method: 'POST',
+		credentials: 'include',
+		headers: { 'Content-Type': 'application/json' },
+		body: JSON.stringify({ visibility })
+	});
+	if (!res.ok) throw new Error('failed to update privacy');
+}
+
+//claim or unclaim a quest, resolves to the updated quest or throws the server's reason
+export async function claimQuest(questId, claim = true) {
+	const res = await fetch(`/api/quests/${questId}/${claim ? 'claim' : 'unclaim'}`, {
+		method: 'POST',
+		credentials: 'include'
+	});
+	if (!res.ok) throw new Error((await res.text()).trim() || 'claim failed');
+	return res.json();
+}
+
+//marks an assigned quest done in asana and scores it right away
+export async function completeQuest(questId) {
+	const res = await fetch(`/api/quests/${questId}/complete`, {
+		method: 'POST',
+		credentials: 'include'
+	});
+	if (!res.ok) throw new Error((await res.text()).trim() || 'complete failed');
+	return res.json();
+}
+
+//open bounties, each with its current (decayed) value
+export async function getBounties(fetchFn = fetch) {
+	const res = await fetchFn(`/api/bounties`, { credentials:'include' });
+	if (!res.ok) throw new Error('failed to load bounties');
+	return res.json();
+}
@@ -0,0 +1,2 @@
+// single page app, the go server hands out index.html and the browser does the rest
+export const ssr = false;
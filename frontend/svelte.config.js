@@ -1,12 +1,15 @@
-import adapter from '@sveltejs/adapter-auto';
+import adapter from '@sveltejs/adapter-static';
 
 /** @type {import('@sveltejs/kit').Config} */
 const config = {
 	kit: {
-		// adapter-auto only supports some environments, see https://svelte.dev/docs/kit/adapter-auto for a list.
-		// If your environment is not supported, or you settled on a specific environment, switch out the adapter.
-		// See https://svelte.dev/docs/kit/adapters for more information about adapters.
-		adapter: adapter()
+		// the go server embeds this build (server/web.go) and serves index.html for any
+		// route it doesn't have a file for, so the whole app renders client side
+		adapter: adapter({
+			pages: '../server/web/build',
+			assets: '../server/web/build',
+			fallback: 'index.html'
+		})
 	}
 };
 
@@ -5,12 +5,11 @@ export default defineConfig({
   plugins: [sveltekit()],
   server: {
     proxy: {
-      // anything starting with /api will be forwarded to Go on 8080
+      // anything starting with /api will be forwarded to Go on 8080, which serves the api there too
       '/api': {
         target: 'http://localhost:8080',
 		secure: false,
-        changeOrigin: true,
-        rewrite: (path) => path.replace(/^\/api/, '')
+        changeOrigin: true
       }
     }
   }
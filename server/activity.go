@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//kinds of rows in the activity table
+const (
+	activityQuestCompleted = "quest_completed"
+	activityRankUp         = "rank_up"
+	activityBadge          = "badge"
+	activityKudos          = "kudos"
+	activitySeason         = "season"
+	activityGrant          = "grant"
+	activityBounty         = "bounty"
+	activityReview         = "review"
+)
+
+type activityItem struct {
+	ID        int64          `json:"id"`
+	Kind      string         `json:"kind"`
+	UserID    string         `json:"user_id"`
+	UserName  string         `json:"user_name"`
+	QuestID   *string        `json:"quest_id,omitempty"`
+	QuestName *string        `json:"quest_name,omitempty"`
+	Points    float64        `json:"points"`
+	Detail    map[string]any `json:"detail"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+func ensureActivityTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS activity (
+		  id BIGSERIAL PRIMARY KEY,
+		  kind TEXT NOT NULL,
+		  user_id TEXT NOT NULL REFERENCES users(id),
+		  quest_id TEXT,
+		  points NUMERIC NOT NULL DEFAULT 0,
+		  detail JSONB NOT NULL DEFAULT '{}',
+		  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+
+		CREATE INDEX IF NOT EXISTS activity_user_idx ON activity(user_id, id DESC);
+		CREATE INDEX IF NOT EXISTS activity_quest_idx ON activity(quest_id, kind);
+	`)
+	return err
+}
+
+func ensureActivityTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS activity (
+		  id INTEGER PRIMARY KEY,
+		  kind TEXT NOT NULL,
+		  user_id TEXT NOT NULL REFERENCES users(id),
+		  quest_id TEXT,
+		  points REAL NOT NULL DEFAULT 0,
+		  detail TEXT NOT NULL DEFAULT '{}',
+		  created_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`
+		);
+
+		CREATE INDEX IF NOT EXISTS activity_user_idx ON activity(user_id, id DESC);
+		CREATE INDEX IF NOT EXISTS activity_quest_idx ON activity(quest_id, kind);
+	`)
+	return err
+}
+
+//*sql.DB or *sql.Tx, so ledger writes can join the caller's transaction
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+//a written activity row, announced once the write that made it committed
+type activityEvent struct {
+	kind   string
+	userID string
+	points float64
+	data   map[string]any
+	//history a sync caught up on, it stays off outgoing notifications
+	backfill bool
+}
+
+//appends one event to the timeline, questID may be empty
+func (s *server) recordActivity(kind, userID, questID string, points float64, detail map[string]any) error {
+	ev, err := insertActivity(s.db, kind, userID, questID, points, detail)
+	if err != nil { return err }
+	s.announce(ev)
+	return nil
+}
+
+func insertActivity(q querier, kind, userID, questID string, points float64, detail map[string]any) (activityEvent, error) {
+	return insertActivityAt(q, time.Now(), kind, userID, questID, points, detail)
+}
+
+//for rows that happened earlier than they're written, like a completion the sync picks up late
+func insertActivityAt(q querier, at time.Time, kind, userID, questID string, points float64, detail map[string]any) (activityEvent, error) {
+	if detail == nil { detail = map[string]any{} }
+	b, err := json.Marshal(detail)
+	if err != nil { return activityEvent{}, err }
+	var qid *string
+	if questID != "" { qid = &questID }
+	var id int64
+	var userName string
+	var questName *string
+	err = q.QueryRow(`insert into activity(kind, user_id, quest_id, points, detail, created_at)
+		values($1,$2,$3,$4,$5,$6)
+		returning id, (select name from users where id=user_id), (select name from quests where id=quest_id)`,
+		kind, userID, qid, points, string(b), at).Scan(&id, &userName, &questName)
+	if err != nil { return activityEvent{}, err }
+	return activityEvent{kind: kind, userID: userID, points: points, data: map[string]any{
+		"id":         id,
+		"user_id":    userID,
+		"user_name":  userName,
+		"quest_id":   qid,
+		"quest_name": questName,
+		"points":     points,
+		"detail":     detail,
+	}}, nil
+}
+
+//metrics and subscribers only hear about rows that made it into the ledger
+func (s *server) announce(evs ...activityEvent) {
+	for _, ev := range evs {
+		//counters only go up, negative grants show in the ledger instead
+		if ev.points > 0 { pointsAwarded.WithLabelValues(ev.kind).Add(ev.points) }
+		s.publishEvent(ev.kind, ev.userID, ev.data, !ev.backfill)
+	}
+}
+
+func (s *server) mountActivity(mux *http.ServeMux) {
+	mux.HandleFunc("GET /activity", s.handleActivity)
+}
+
+//GET /activity?user=&guild=&kind=&before=&limit=
+//newest first, pass next_before back as before to get the next page. rows of
+//users whose profile the caller can't see are left out
+func (s *server) handleActivity(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 50
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 && v <= 200 {
+		limit = v
+	}
+	var wc whereClause
+	if v := q.Get("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil { http.Error(w, "bad before cursor", 400); return }
+		wc.add("a.id < ?", n)
+	}
+	viewer := s.profileViewer(r)
+	if v := q.Get("user"); v != "" {
+		//same answer as the profile, a hidden user's feed doesn't exist
+		var visibility string
+		err := s.db.QueryRow(`select profile_visibility from users where id=$1`, v).Scan(&visibility)
+		if errors.Is(err, sql.ErrNoRows) || err == nil && !canSeeProfile(visibility, v, viewer) {
+			http.Error(w, "not found", 404); return
+		}
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		wc.add("a.user_id = ?", v)
+	}
+	if v := q.Get("guild"); v != "" {
+		var exists bool
+		if err := s.db.QueryRow(`select exists(select 1 from guilds where id=$1)`, v).Scan(&exists); err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		if !exists { http.Error(w, "not found", 404); return }
+		wc.add("exists (select 1 from guild_members gm where gm.guild_id = ? and gm.user_id = a.user_id)", v)
+	}
+	if v := q.Get("kind"); v != "" { wc.add("a.kind = ?", v) }
+	wc.visibleTo(viewer)
+
+	rows, err := s.db.Query(`
+		select a.id, a.kind, a.user_id, u.name, a.quest_id, qu.name, a.points, a.detail, a.created_at
+		from activity a
+		join users u on u.id = a.user_id
+		left join quests qu on qu.id = a.quest_id
+		`+wc.sql()+`
+		order by a.id desc
+		limit `+wc.arg(limit), wc.args...)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	defer rows.Close()
+
+	items := []activityItem{}
+	for rows.Next() {
+		var it activityItem
+		var detail []byte
+		if err := rows.Scan(&it.ID, &it.Kind, &it.UserID, &it.UserName, &it.QuestID, &it.QuestName,
+			&it.Points, &detail, &it.CreatedAt); err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		_ = json.Unmarshal(detail, &it.Detail)
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil { http.Error(w, err.Error(), 500); return }
+
+	var next *int64
+	if len(items) == limit {
+		next = &items[len(items)-1].ID
+	}
+	writeJSON(w, map[string]any{
+		"items":       items,
+		"next_before": next,
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s *server) mountAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("POST /admin/grant", s.handleAdminGrant)
+}
+
+//POST /admin/grant {"user_id":"...","points":5,"reason":"..."}
+//same as the grant cli command
+func (s *server) handleAdminGrant(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireScope(w, r, scopeAdmin); !ok { return }
+
+	var body struct {
+		UserID string  `json:"user_id"`
+		Points float64 `json:"points"`
+		Reason string  `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, "bad json", 400); return }
+	if body.UserID == "" || body.Points == 0 || body.Reason == "" {
+		http.Error(w, "user_id, points and reason are required", 400); return
+	}
+	if err := s.grantPoints(body.UserID, body.Points, body.Reason); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	row, _, err := s.userStanding(body.UserID)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, row)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -13,22 +14,35 @@ import (
 
 type asanaTask struct {
 	Gid string `json:"gid"`
+	Name string `json:"name"`
 	Completed bool `json:"completed"`
+	CompletedAt *time.Time `json:"completed_at"`
+	DueOn string `json:"due_on"`
+	DueAt *time.Time `json:"due_at"`
 	Assignee *struct {
 		Gid string `json:"gid"`
 		Name string `json:"name"`
+		Photo *struct{ Image128 string `json:"image_128x128"` } `json:"photo"`
 	} `json:"assignee"`
+	CustomFields []map[string]any `json:"custom_fields"`
+	Memberships []struct {
+		Project struct{ Gid string `json:"gid"` } `json:"project"`
+		Section *struct{ Name string `json:"name"` } `json:"section"`
+	} `json:"memberships"`
 }
 
+//the credential every asana call is made with. handlers resolve it from the
+//session once, jobs get it from serviceTokens or tokensForUser
 type asanaTokens struct {
 	AccessToken  string
 	RefreshToken string
 	ExpiresAt    time.Time
 	UserID       string // asana gid
+	Scope        string // as granted at login, "default" is full access
 }
 
-func (s *server) listAllProjectTasks(r *http.Request, projectGID string) ([]asanaTask, error) {
-	fields := "gid,completed,assignee.gid,assignee.name"
+func (s *server) listAllProjectTasks(ctx context.Context, t *asanaTokens, projectGID string) ([]asanaTask, error) {
+	fields := "gid,name,completed,completed_at,due_on,due_at,assignee.gid,assignee.name,assignee.photo.image_128x128,custom_fields.name,custom_fields.display_value,memberships.project.gid,memberships.section.name"
 	var all []asanaTask
 	offset := ""
 	for {
@@ -43,7 +57,7 @@ func (s *server) listAllProjectTasks(r *http.Request, projectGID string) ([]asan
 			Data     []asanaTask `json:"data"`
 			NextPage *struct{ Offset string `json:"offset"` } `json:"next_page"`
 		}
-		if err := s.asanaGET(r, "/projects/"+projectGID+"/tasks", q, &page); err != nil {
+		if err := s.asanaGET(ctx, t, "/projects/"+projectGID+"/tasks", q, &page); err != nil {
 			return nil, err
 		}
 		all = append(all, page.Data...)
@@ -53,40 +67,54 @@ func (s *server) listAllProjectTasks(r *http.Request, projectGID string) ([]asan
 	return all, nil
 }
 
+//the logged in user's credential, only for use inside handlers
 func (s *server) tokensForRequest(r *http.Request) (*asanaTokens, error) {
-	sid := getSessionCookie(r)
-	if sid == "" {
-		return nil, errors.New("no session")
+	userID, err := s.sessionUserID(r)
+	if err != nil { return nil, err }
+	return s.tokensForUser(r.Context(), userID)
+}
+
+//credentials for work no user is waiting on, like the periodic sync
+func (s *server) serviceTokens(ctx context.Context) (*asanaTokens, error) {
+	if s.cfg.AsanaPAT != "" {
+		//PATs don't expire, so no refresh token and no owner row to update
+		return &asanaTokens{AccessToken: s.cfg.AsanaPAT, Scope: "default"}, nil
+	}
+	if s.cfg.AsanaServiceUser != "" {
+		return s.tokensForUser(ctx, s.cfg.AsanaServiceUser)
 	}
-	var t asanaTokens
-	err := s.db.QueryRow(`
-		select oa.access_token, oa.refresh_token, coalesce(oa.expires_at, now()), s.user_id
-		from sessions s
-		join oauth_accounts oa on oa.user_id = s.user_id and oa.provider='asana'
-		where s.id=$1`, sid).Scan(&t.AccessToken, &t.RefreshToken, &t.ExpiresAt, &t.UserID)
+	return nil, errors.New("no service identity, set ASANA_PERSONAL_A_TOKEN or ASANA_SERVICE_USER")
+}
+
+//stored oauth tokens for a user, refreshed if they are about to expire
+func (s *server) tokensForUser(ctx context.Context, userID string) (*asanaTokens, error) {
+	t, err := s.users.AsanaTokens(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
 	if time.Now().After(t.ExpiresAt.Add(-2 * time.Minute)) && t.RefreshToken != "" {
-		if err := s.refreshAsanaTokens(&t); err != nil {
+		if err := s.refreshAsanaTokens(ctx, t); err != nil {
+			tokenRefreshes.WithLabelValues("error").Inc()
 			return nil, err
 		}
+		tokenRefreshes.WithLabelValues("ok").Inc()
 	}
-	return &t, nil
+	return t, nil
 }
 
-func (s *server) refreshAsanaTokens(t *asanaTokens) error {
-	cfg := loadOAuth()
+func (s *server) refreshAsanaTokens(ctx context.Context, t *asanaTokens) error {
+	cfg := s.cfg.oauth()
 	form := url.Values{}
 	form.Set("grant_type", "refresh_token")
 	form.Set("client_id", cfg.clientID)
 	form.Set("client_secret", cfg.clientSecret)
 	form.Set("refresh_token", t.RefreshToken)
 
-	req, _ := http.NewRequest("POST", "https://app.asana.com/-/oauth_token", strings.NewReader(form.Encode()))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://app.asana.com/-/oauth_token", strings.NewReader(form.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	res, err := http.DefaultClient.Do(req)
+	if id := requestIDFrom(ctx); id != "" { req.Header.Set("X-Request-ID", id) }
+	res, err := asanaHTTP.Do(req)
 	if err != nil { return err }
 	defer res.Body.Close()
 
@@ -109,37 +137,68 @@ func (s *server) refreshAsanaTokens(t *asanaTokens) error {
 	}
 	t.ExpiresAt = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
 
-	_, err = s.db.Exec(`update oauth_accounts
-		set access_token=$1, refresh_token=$2, expires_at=$3
-		where user_id=$4 and provider='asana'`,
-		t.AccessToken, t.RefreshToken, t.ExpiresAt, t.UserID)
-	return err
+	return s.users.SaveAsanaTokens(ctx, t)
+}
+
+//a non-200 answer from asana, the message is the body asana sent
+type asanaError struct {
+	status int
+	body   string
+}
+
+func (e *asanaError) Error() string { return e.body }
+
+//true when asana answered err with status
+func isAsanaStatus(err error, status int) bool {
+	var ae *asanaError
+	return errors.As(err, &ae) && ae.status == status
+}
+
+//ctx carries the deadline and the request id, which is sent along as
+//X-Request-ID and logged
+func (s *server) asanaGET(ctx context.Context, t *asanaTokens, path string, q url.Values, out any) error {
+	return s.asanaDo(ctx, t, "GET", path, q, nil, out)
 }
 
-func (s *server) asanaGET(r *http.Request, path string, q url.Values, out any) error {
-	t, err := s.tokensForRequest(r)
+//asana wants write bodies wrapped in {"data": ...}
+func (s *server) asanaPUT(ctx context.Context, t *asanaTokens, path string, data any, out any) error {
+	b, err := json.Marshal(map[string]any{"data": data})
 	if err != nil { return err }
-	if q == nil { q = url.Values{} }
+	return s.asanaDo(ctx, t, "PUT", path, nil, b, out)
+}
+
+func (s *server) asanaDo(ctx context.Context, t *asanaTokens, method, path string, q url.Values, body []byte, out any) error {
 	u := "https://app.asana.com/api/1.0" + path
 	if len(q) > 0 { u += "?" + q.Encode() }
 
-	req, _ := http.NewRequestWithContext(context.Background(), "GET", u, nil)
+	var rd io.Reader
+	if body != nil { rd = bytes.NewReader(body) }
+	req, _ := http.NewRequestWithContext(ctx, method, u, rd)
 	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
+	if body != nil { req.Header.Set("Content-Type", "application/json") }
+	if id := requestIDFrom(ctx); id != "" { req.Header.Set("X-Request-ID", id) }
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil { return err }
+	start := time.Now()
+	res, err := asanaHTTP.Do(req)
+	if err != nil {
+		logFrom(ctx).Warn("asana call failed", "method", method, "path", path, "err", err)
+		return err
+	}
 	defer res.Body.Close()
+	logFrom(ctx).Debug("asana call", "method", method, "path", path, "status", res.StatusCode,
+		"duration_ms", time.Since(start).Milliseconds())
 
 	// if res.StatusCode != http.StatusOK {
 	// 	b, _ := io.ReadAll(res.Body)
 	// 	return errors.New("asana GET failed: " + string(b))
 	// }
-	if res.StatusCode != http.StatusOK {
+	//creating things answers 201
+	if res.StatusCode/100 != 2 {
 		b, _ := io.ReadAll(res.Body)
-		httpErr := errors.New(string(b))
-		return httpErr
+		return &asanaError{status: res.StatusCode, body: string(b)}
 	}
 
+	if out == nil { return nil }
 	return json.NewDecoder(res.Body).Decode(out)
 }
 
@@ -11,12 +11,14 @@ func (s *server) mountAsana(mux *http.ServeMux) {
 	mux.HandleFunc("GET /asana/projects", s.handleAsanaProjects)
 	mux.HandleFunc("GET /asana/projects/{gid}/tasks", s.handleAsanaProjectTasks)
 	mux.HandleFunc("POST /asana/sync/me", s.handleSyncMe)
+	mux.HandleFunc("POST /asana/webhook", s.handleAsanaWebhook)
 }
 
 //GET /asana/projects
 func (s *server) handleAsanaProjects(w http.ResponseWriter, r *http.Request) {
 	//first, get the user's workspaces
-	if _, err := s.tokensForRequest(r); err != nil {
+	t, err := s.tokensForRequest(r)
+	if err != nil {
 		http.Error(w, "not logged in", http.StatusUnauthorized)
 		return
 	}
@@ -24,7 +26,7 @@ func (s *server) handleAsanaProjects(w http.ResponseWriter, r *http.Request) {
 	var me struct{ Data struct {
 		Workspaces []struct{ Gid, Name string } `json:"workspaces"`
 	} `json:"data"` }
-	if err := s.asanaGET(r, "/users/me", url.Values{"opt_fields":{"workspaces.name"}}, &me); err != nil {
+	if err := s.asanaGET(r.Context(), t, "/users/me", url.Values{"opt_fields":{"workspaces.name"}}, &me); err != nil {
 		http.Error(w, err.Error(), 502); return
 	}
 	ws := ""
@@ -43,7 +45,7 @@ func (s *server) handleAsanaProjects(w http.ResponseWriter, r *http.Request) {
 		"opt_fields": {"name"},
 		"limit":      {"100"},
 	}
-	if err := s.asanaGET(r, "/projects", q, &resp); err != nil {
+	if err := s.asanaGET(r.Context(), t, "/projects", q, &resp); err != nil {
 		http.Error(w, err.Error(), 502); return
 	}
 	writeJSON(w, resp.Data)
@@ -51,7 +53,8 @@ func (s *server) handleAsanaProjects(w http.ResponseWriter, r *http.Request) {
 
 //GET /asana/projects/{gid}/tasks
 func (s *server) handleAsanaProjectTasks(w http.ResponseWriter, r *http.Request) {
-	if _, err := s.tokensForRequest(r); err != nil {
+	t, err := s.tokensForRequest(r)
+	if err != nil {
 		http.Error(w, "not logged in", http.StatusUnauthorized)
 		return
 	}
@@ -93,7 +96,7 @@ func (s *server) handleAsanaProjectTasks(w http.ResponseWriter, r *http.Request)
 			Data []map[string]any `json:"data"`
 			NextPage *struct{ Offset string `json:"offset"` } `json:"next_page"`
 		}
-		if err := s.asanaGET(r, "/projects/"+gid+"/tasks", q, &page); err != nil {
+		if err := s.asanaGET(r.Context(), t, "/projects/"+gid+"/tasks", q, &page); err != nil {
 			http.Error(w, err.Error(), 502); return
 		}
 		for _, t := range page.Data { all = append(all, t) }
@@ -105,15 +108,11 @@ func (s *server) handleAsanaProjectTasks(w http.ResponseWriter, r *http.Request)
 
 
 func (s *server) handleSyncMe(w http.ResponseWriter, r *http.Request) {
-	//get current session user
-	sid := getSessionCookie(r)
-	if sid == "" { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
-
-	var userID string
-	err := s.db.QueryRow(`select user_id from sessions where id=$1`, sid).Scan(&userID)
+	//get current session user and their asana login
+	t, err := s.tokensForRequest(r)
 	if err != nil { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
 
-	if err := s.recomputePointsForUser(r, userID); err != nil {
+	if err := s.recomputePointsForUser(r.Context(), t, t.UserID); err != nil {
 		http.Error(w, err.Error(), 502); return
 	}
 	w.WriteHeader(http.StatusNoContent)
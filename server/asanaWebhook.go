@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//with ASANA_WEBHOOKS=true asana posts changes in the project to
+//PUBLIC_API_URL/asana/webhook and each delivery triggers a sync. polling
+//carries on slower while the webhook is live, and at SYNC_INTERVAL when it isn't
+
+//how long after we ask asana for a webhook its handshake is accepted
+const webhookHandshakeWindow = time.Minute
+
+func ensureWebhookTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS asana_webhooks (
+		  project_id TEXT PRIMARY KEY,
+		  webhook_gid TEXT,
+		  secret TEXT,
+		  requested_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+	`)
+	return err
+}
+
+func ensureWebhookTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS asana_webhooks (
+		  project_id TEXT PRIMARY KEY,
+		  webhook_gid TEXT,
+		  secret TEXT,
+		  requested_at TIMESTAMP NOT NULL DEFAULT ` + sqliteNow + `
+		);
+	`)
+	return err
+}
+
+func (s *server) webhookTarget(projectGID string) string {
+	return s.cfg.PublicAPIURL + "/asana/webhook?project=" + url.QueryEscape(projectGID)
+}
+
+//makes sure asana has an active webhook on the project, registering a new one
+//when there is none or asana turned ours off after failed deliveries
+func (s *server) ensureWebhook(ctx context.Context, t *asanaTokens, projectGID string) error {
+	var gid *string
+	err := s.db.QueryRowContext(ctx, `select webhook_gid from asana_webhooks where project_id=$1`, projectGID).Scan(&gid)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { return err }
+	if gid != nil {
+		var res struct{ Data struct{ Active bool `json:"active"` } `json:"data"` }
+		err := s.asanaGET(ctx, t, "/webhooks/"+*gid, url.Values{"opt_fields": {"active"}}, &res)
+		if err == nil && res.Data.Active { return nil }
+		if err != nil && !isAsanaStatus(err, http.StatusNotFound) { return err }
+		if err == nil { _ = s.asanaDo(ctx, t, "DELETE", "/webhooks/"+*gid, nil, nil, nil) }
+	}
+
+	//asana sends the handshake with the secret before it answers the POST
+	_, err = s.db.ExecContext(ctx, `insert into asana_webhooks(project_id, requested_at) values($1,$2)
+		on conflict (project_id) do update set webhook_gid=null, secret=null, requested_at=excluded.requested_at`,
+		projectGID, time.Now())
+	if err != nil { return err }
+	body, err := json.Marshal(map[string]any{"data": map[string]any{
+		"resource": projectGID,
+		"target":   s.webhookTarget(projectGID),
+	}})
+	if err != nil { return err }
+	var created struct{ Data struct{ Gid string `json:"gid"` } `json:"data"` }
+	if err := s.asanaDo(ctx, t, "POST", "/webhooks", nil, body, &created); err != nil { return err }
+	_, err = s.db.ExecContext(ctx, `update asana_webhooks set webhook_gid=$2 where project_id=$1`, projectGID, created.Data.Gid)
+	return err
+}
+
+//POST /asana/webhook?project=
+//the handshake echoes X-Hook-Secret back, later deliveries must be signed with it
+func (s *server) handleAsanaWebhook(w http.ResponseWriter, r *http.Request) {
+	project := r.URL.Query().Get("project")
+	if secret := r.Header.Get("X-Hook-Secret"); secret != "" {
+		//only while our own registration waits for it, so nobody else can swap the secret
+		res, err := s.db.Exec(`update asana_webhooks set secret=$2
+			where project_id=$1 and secret is null and requested_at > $3`,
+			project, secret, time.Now().Add(-webhookHandshakeWindow))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "no webhook pending", 403); return }
+		w.Header().Set("X-Hook-Secret", secret)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil { http.Error(w, "bad body", 400); return }
+	var secret string
+	err = s.db.QueryRow(`select coalesce(secret,'') from asana_webhooks where project_id=$1`, project).Scan(&secret)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { http.Error(w, err.Error(), 500); return }
+	//410 tells asana to drop a webhook we no longer know about
+	if secret == "" || project != s.cfg.AsanaProjectID { http.Error(w, "unknown webhook", http.StatusGone); return }
+	if !verifyAsanaSignature(secret, r.Header.Get("X-Hook-Signature"), body) {
+		http.Error(w, "bad signature", http.StatusUnauthorized); return
+	}
+	s.kickSync()
+	w.WriteHeader(http.StatusOK)
+}
+
+//X-Hook-Signature is the hex hmac-sha256 of the body keyed with the handshake secret
+func verifyAsanaSignature(secret, sig string, body []byte) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(sig))
+}
+
+//asks the sync loop for a run now, kicks while one is queued fold into it
+func (s *server) kickSync() {
+	select {
+	case s.syncKick <- struct{}{}:
+	default:
+	}
+}
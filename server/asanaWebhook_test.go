@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAsanaWebhook(t *testing.T) {
+	s := newSQLiteTestServer(t)
+	s.cfg.AsanaProjectID = "P1"
+	ctx := context.Background()
+	tokens := &asanaTokens{AccessToken: "pat", Scope: "default"}
+	asana := newFakeAsana(t)
+
+	post := func(target string, header map[string]string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		for k, v := range header { r.Header.Set(k, v) }
+		w := httptest.NewRecorder()
+		s.handleAsanaWebhook(w, r)
+		return w
+	}
+	target := s.webhookTarget("P1")
+	if w := post(target, map[string]string{"X-Hook-Secret": "forged"}, ""); w.Code != 403 {
+		t.Fatalf("unrequested handshake = %d, want 403", w.Code)
+	}
+
+	secret := "s1"
+	asana.handshake = func(target string) {
+		w := post(target, map[string]string{"X-Hook-Secret": secret}, "")
+		if w.Code != 200 || w.Header().Get("X-Hook-Secret") != secret { t.Errorf("handshake = %d %q", w.Code, w.Header().Get("X-Hook-Secret")) }
+	}
+	if err := s.ensureWebhook(ctx, tokens, "P1"); err != nil { t.Fatal(err) }
+	if w := post(target, map[string]string{"X-Hook-Secret": "forged"}, ""); w.Code != 403 {
+		t.Errorf("second handshake = %d, want 403", w.Code)
+	}
+
+	sign := func(secret, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	body := `{"events":[{"action":"changed"}]}`
+	if w := post(target, map[string]string{"X-Hook-Signature": sign("forged", body)}, body); w.Code != 401 {
+		t.Errorf("badly signed event = %d, want 401", w.Code)
+	}
+	if len(s.syncKick) != 0 { t.Error("badly signed event kicked a sync") }
+	if w := post(target, map[string]string{"X-Hook-Signature": sign(secret, body)}, body); w.Code != 200 {
+		t.Errorf("signed event = %d, want 200", w.Code)
+	}
+	if len(s.syncKick) != 1 { t.Error("signed event didn't kick a sync") }
+	if w := post(s.webhookTarget("P2"), map[string]string{"X-Hook-Signature": sign(secret, body)}, body); w.Code != 410 {
+		t.Errorf("event for an unknown project = %d, want 410", w.Code)
+	}
+
+	//a live webhook is left alone, one asana deactivated is replaced
+	if err := s.ensureWebhook(ctx, tokens, "P1"); err != nil { t.Fatal(err) }
+	if len(asana.hooks) != 1 { t.Fatalf("%d webhooks, want 1", len(asana.hooks)) }
+	asana.hooks["W1"] = false
+	secret = "s2"
+	if err := s.ensureWebhook(ctx, tokens, "P1"); err != nil { t.Fatal(err) }
+	if len(asana.hooks) != 1 || !asana.hooks["W1"] { t.Errorf("webhooks %v, want only a fresh one", asana.hooks) }
+	<-s.syncKick
+	if w := post(target, map[string]string{"X-Hook-Signature": sign("s1", body)}, body); w.Code != 401 {
+		t.Errorf("event signed with the old secret = %d, want 401", w.Code)
+	}
+}
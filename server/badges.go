@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+//what a user has done so far, as far as badges care
+type badgeStats struct {
+	completed, hard, streak int
+	champion                bool
+}
+
+type badge struct {
+	id, name string
+	earned   func(badgeStats) bool
+}
+
+//kept forever once earned, a later recompute or a broken streak doesn't take them back
+var badges = []badge{
+	{"first_quest", "First quest", func(st badgeStats) bool { return st.completed >= 1 }},
+	{"ten_quests", "Ten quests", func(st badgeStats) bool { return st.completed >= 10 }},
+	{"hard_quest", "Took on a hard one", func(st badgeStats) bool { return st.hard >= 1 }},
+	{"streak_7", "Seven day streak", func(st badgeStats) bool { return st.streak >= 7 }},
+	{"season_champion", "Season champion", func(st badgeStats) bool { return st.champion }},
+}
+
+func ensureBadgeTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_badges (
+		  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		  badge TEXT NOT NULL,
+		  awarded_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		  PRIMARY KEY (user_id, badge)
+		);
+	`)
+	return err
+}
+
+func ensureBadgeTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_badges (
+		  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		  badge TEXT NOT NULL,
+		  awarded_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`,
+		  PRIMARY KEY (user_id, badge)
+		);
+	`)
+	return err
+}
+
+func (s *server) badgeStats(userID string) (badgeStats, error) {
+	var st badgeStats
+	err := s.db.QueryRow(`
+		select count(*), count(*) filter (where difficulty = 'hard')
+		from quests where completed and completed_by=$1`, userID).Scan(&st.completed, &st.hard)
+	if err != nil { return st, err }
+	err = s.db.QueryRow(`select exists(select 1 from season_standings where user_id=$1 and rank=1)`, userID).Scan(&st.champion)
+	if err != nil { return st, err }
+	st.streak, err = s.streakOf(userID)
+	return st, err
+}
+
+//hands out every badge the user qualifies for and doesn't have yet, each one
+//lands in the activity feed and on the profile
+func (s *server) checkBadges(userID string) error {
+	st, err := s.badgeStats(userID)
+	if err != nil { return err }
+	for _, b := range badges {
+		if !b.earned(st) { continue }
+		res, err := s.db.Exec(`insert into user_badges(user_id, badge, awarded_at) values($1,$2,$3)
+			on conflict (user_id, badge) do nothing`, userID, b.id, time.Now())
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 { continue }
+		err = s.recordActivity(activityBadge, userID, "", 0, map[string]any{
+			"badge": b.id,
+			"name":  b.name,
+		})
+		if err != nil { return err }
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBadgesAndSeasonStats(t *testing.T) {
+	s := newSQLiteTestServer(t)
+	if _, err := s.db.Exec(`insert into users(id, name) values('U1','U1')`); err != nil { t.Fatal(err) }
+	_, err := s.db.Exec(`insert into quests(id, name, difficulty, completed, completed_by, completed_at)
+		values('T1','fix the build','hard',true,'U1',$1)`, time.Now())
+	if err != nil { t.Fatal(err) }
+	if err := s.recordActivity(activityQuestCompleted, "U1", "T1", 3, nil); err != nil { t.Fatal(err) }
+
+	//rescoring twice hands each badge out once
+	for range 2 {
+		if err := s.rescoreUser("U1"); err != nil { t.Fatal(err) }
+	}
+	if n := countActivity(t, s, activityBadge, "U1"); n != 2 { t.Errorf("U1 badges = %d, want first_quest and hard_quest", n) }
+
+	p := profile{UserID: "U1", Name: "U1"}
+	if err := s.fillProfile(&p); err != nil { t.Fatal(err) }
+	if p.Season == nil || p.Season.Rank != 1 || p.Season.Points != 3 || len(p.PastSeasons) != 0 {
+		t.Errorf("season stats before close = %+v %+v", p.Season, p.PastSeasons)
+	}
+
+	if _, _, err := s.closeSeason(""); err != nil { t.Fatal(err) }
+	p = profile{UserID: "U1", Name: "U1"}
+	if err := s.fillProfile(&p); err != nil { t.Fatal(err) }
+	if len(p.Badges) != 3 || p.Badges[0].Detail["badge"] != "season_champion" { t.Errorf("badges = %+v", p.Badges) }
+	if p.Season.Rank != 0 || p.Season.Season != "Season 2" { t.Errorf("new season = %+v", p.Season) }
+	if len(p.PastSeasons) != 1 || p.PastSeasons[0].Rank != 1 || p.PastSeasons[0].Points != 3 {
+		t.Errorf("past seasons = %+v", p.PastSeasons)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+)
+
+//extra points on top of a quest's difficulty weight, set by an admin and
+//paid out by awardCompletion
+type bounty struct {
+	QuestID     string     `json:"quest_id"`
+	QuestName   string     `json:"quest_name"`
+	Points      float64    `json:"points"`
+	DecayPerDay float64    `json:"decay_per_day"`
+	FirstOnly   bool       `json:"first_only"`
+	Deadline    *time.Time `json:"deadline,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	AwardedTo   *string    `json:"awarded_to,omitempty"`
+	//what completing it right now would pay
+	Current float64 `json:"current"`
+}
+
+//decays linearly by decay_per_day from posting, zero after the deadline
+func (b *bounty) valueAt(t time.Time) float64 {
+	if b.Deadline != nil && t.After(*b.Deadline) { return 0 }
+	days := t.Sub(b.CreatedAt).Hours() / 24
+	if days < 0 { days = 0 }
+	return math.Max(0, b.Points-b.DecayPerDay*days)
+}
+
+func ensureBountyTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS bounties (
+		  quest_id TEXT PRIMARY KEY,
+		  points NUMERIC NOT NULL,
+		  decay_per_day NUMERIC NOT NULL DEFAULT 0,
+		  first_only BOOLEAN NOT NULL DEFAULT false,
+		  deadline TIMESTAMPTZ,
+		  created_by TEXT REFERENCES users(id),
+		  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		  awarded_to TEXT REFERENCES users(id),
+		  awarded_at TIMESTAMPTZ
+		);
+	`)
+	return err
+}
+
+func ensureBountyTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS bounties (
+		  quest_id TEXT PRIMARY KEY,
+		  points REAL NOT NULL,
+		  decay_per_day REAL NOT NULL DEFAULT 0,
+		  first_only BOOLEAN NOT NULL DEFAULT false,
+		  deadline TIMESTAMP,
+		  created_by TEXT REFERENCES users(id),
+		  created_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`,
+		  awarded_to TEXT REFERENCES users(id),
+		  awarded_at TIMESTAMP
+		);
+	`)
+	return err
+}
+
+const bountyCols = `b.quest_id, coalesce(q.name, ''), b.points, b.decay_per_day, b.first_only, b.deadline, b.created_at, b.awarded_to`
+
+func scanBounty(row interface{ Scan(...any) error }) (*bounty, error) {
+	var b bounty
+	err := row.Scan(&b.QuestID, &b.QuestName, &b.Points, &b.DecayPerDay, &b.FirstOnly, &b.Deadline, &b.CreatedAt, &b.AwardedTo)
+	if err != nil { return nil, err }
+	return &b, nil
+}
+
+//pays the quest's bounty, if any, valued at when the quest was completed.
+//runs in awardCompletion's tx, which only gets here once per quest and user.
+//first_only bounties are marked awarded in the same statement that checks them
+func awardBounty(tx *sql.Tx, questID, userID string) ([]activityEvent, error) {
+	b, err := scanBounty(tx.QueryRow(`select `+bountyCols+`
+		from bounties b left join quests q on q.id = b.quest_id
+		where b.quest_id=$1`, questID))
+	if errors.Is(err, sql.ErrNoRows) { return nil, nil }
+	if err != nil { return nil, err }
+
+	var completedAt *time.Time
+	err = tx.QueryRow(`select completed_at from quests where id=$1`, questID).Scan(&completedAt)
+	if err != nil { return nil, err }
+	if completedAt == nil { now := time.Now(); completedAt = &now }
+	value := b.valueAt(*completedAt)
+	if value <= 0 { return nil, nil }
+
+	if b.FirstOnly {
+		res, err := tx.Exec(`update bounties set awarded_to=$2, awarded_at=$3
+			where quest_id=$1 and awarded_to is null`, questID, userID, time.Now())
+		if err != nil { return nil, err }
+		if n, _ := res.RowsAffected(); n == 0 { return nil, nil }
+	}
+	ev, err := insertActivity(tx, activityBounty, userID, questID, value, map[string]any{
+		"posted":     b.Points,
+		"first_only": b.FirstOnly,
+	})
+	if err != nil { return nil, err }
+	return []activityEvent{ev}, nil
+}
+
+func (s *server) mountBounties(mux *http.ServeMux) {
+	mux.HandleFunc("GET /bounties", s.handleListBounties)
+	mux.HandleFunc("POST /bounties", s.handlePostBounty)
+	mux.HandleFunc("POST /bounties/{id}/cancel", s.handleCancelBounty)
+}
+
+//GET /bounties
+//open bounties only: quest not done, deadline ahead, first_only not yet won
+func (s *server) handleListBounties(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	rows, err := s.db.Query(`select `+bountyCols+`
+		from bounties b join quests q on q.id = b.quest_id
+		where not q.completed
+		  and (b.deadline is null or b.deadline > $1)
+		  and b.awarded_to is null
+		order by b.deadline asc nulls last, b.points desc`, now)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	defer rows.Close()
+
+	out := []bounty{}
+	for rows.Next() {
+		b, err := scanBounty(rows)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		b.Current = b.valueAt(now)
+		if b.Current <= 0 { continue }
+		out = append(out, *b)
+	}
+	writeJSON(w, out)
+}
+
+//POST /bounties {"quest_id":"...","points":5,"decay_per_day":1,"first_only":true,"deadline":"2025-06-01T00:00:00Z"}
+//posting again replaces the quest's bounty
+func (s *server) handlePostBounty(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.requireScope(w, r, scopeAdmin)
+	if !ok { return }
+
+	var body struct {
+		QuestID     string     `json:"quest_id"`
+		Points      float64    `json:"points"`
+		DecayPerDay float64    `json:"decay_per_day"`
+		FirstOnly   bool       `json:"first_only"`
+		Deadline    *time.Time `json:"deadline"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, "bad json", 400); return }
+	if body.QuestID == "" || body.Points <= 0 || body.DecayPerDay < 0 {
+		http.Error(w, "quest_id and positive points are required, decay_per_day can't be negative", 400); return
+	}
+	if body.Deadline != nil && !body.Deadline.After(time.Now()) { http.Error(w, "deadline is in the past", 400); return }
+
+	var completed bool
+	err := s.db.QueryRow(`select completed from quests where id=$1`, body.QuestID).Scan(&completed)
+	if errors.Is(err, sql.ErrNoRows) { http.Error(w, "quest not found", 404); return }
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if completed { http.Error(w, "quest is already completed", 409); return }
+
+	_, err = s.db.Exec(`
+		insert into bounties(quest_id, points, decay_per_day, first_only, deadline, created_by, created_at)
+		values($1,$2,$3,$4,$5,$6,$7)
+		on conflict (quest_id) do update set
+		  points=excluded.points,
+		  decay_per_day=excluded.decay_per_day,
+		  first_only=excluded.first_only,
+		  deadline=excluded.deadline,
+		  created_by=excluded.created_by,
+		  created_at=excluded.created_at,
+		  awarded_to=null,
+		  awarded_at=null`,
+		body.QuestID, body.Points, body.DecayPerDay, body.FirstOnly, body.Deadline, userID, time.Now())
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	b, err := scanBounty(s.db.QueryRow(`select `+bountyCols+`
+		from bounties b left join quests q on q.id = b.quest_id
+		where b.quest_id=$1`, body.QuestID))
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	b.Current = b.valueAt(time.Now())
+	s.publish("bounty_posted", "", b)
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, b)
+}
+
+//POST /bounties/{id}/cancel
+func (s *server) handleCancelBounty(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireScope(w, r, scopeAdmin); !ok { return }
+
+	res, err := s.db.Exec(`delete from bounties where quest_id=$1 and awarded_to is null`, r.PathValue("id"))
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "not found", 404); return }
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBountyValueAt(t *testing.T) {
+	posted := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	deadline := posted.Add(72 * time.Hour)
+	cases := []struct {
+		name  string
+		b     bounty
+		at    time.Time
+		value float64
+	}{
+		{"no decay", bounty{Points: 5, CreatedAt: posted}, posted.Add(100 * 24 * time.Hour), 5},
+		{"at posting", bounty{Points: 5, DecayPerDay: 1, CreatedAt: posted}, posted, 5},
+		{"two days in", bounty{Points: 5, DecayPerDay: 1, CreatedAt: posted}, posted.Add(48 * time.Hour), 3},
+		{"half a day in", bounty{Points: 5, DecayPerDay: 1, CreatedAt: posted}, posted.Add(12 * time.Hour), 4.5},
+		{"decayed away", bounty{Points: 5, DecayPerDay: 1, CreatedAt: posted}, posted.Add(10 * 24 * time.Hour), 0},
+		{"before posting", bounty{Points: 5, DecayPerDay: 1, CreatedAt: posted}, posted.Add(-48 * time.Hour), 5},
+		{"on the deadline", bounty{Points: 5, CreatedAt: posted, Deadline: &deadline}, deadline, 5},
+		{"past the deadline", bounty{Points: 5, CreatedAt: posted, Deadline: &deadline}, deadline.Add(time.Second), 0},
+	}
+	for _, c := range cases {
+		if got := c.b.valueAt(c.at); got != c.value { t.Errorf("%s: valueAt = %v, want %v", c.name, got, c.value) }
+	}
+}
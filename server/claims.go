@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errQuestNotFound = errors.New("quest not found")
+	errQuestDone     = errors.New("quest is already completed")
+	errQuestTaken    = errors.New("quest is assigned to someone else")
+	errNotClaimer    = errors.New("quest isn't assigned to you")
+	errClaimLimit    = errors.New("claim limit reached, finish or unclaim a quest first")
+	errNoWriteScope  = errors.New("your asana login can't edit tasks, log in again to grant tasks:write")
+)
+
+//quest_claims.expire_error says why expiry gave up on a claim, it isn't retried while set
+func ensureClaimTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		ALTER TABLE quests ADD COLUMN IF NOT EXISTS assignee_id TEXT REFERENCES users(id);
+
+		CREATE TABLE IF NOT EXISTS quest_claims (
+		  quest_id TEXT PRIMARY KEY REFERENCES quests(id) ON DELETE CASCADE,
+		  user_id TEXT NOT NULL REFERENCES users(id),
+		  claimed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS quest_claims_user_idx ON quest_claims(user_id);
+		ALTER TABLE quest_claims ADD COLUMN IF NOT EXISTS expire_error TEXT;
+	`)
+	return err
+}
+
+//quests.assignee_id is inline in the sqlite quests table
+func ensureClaimTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS quest_claims (
+		  quest_id TEXT PRIMARY KEY REFERENCES quests(id) ON DELETE CASCADE,
+		  user_id TEXT NOT NULL REFERENCES users(id),
+		  claimed_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`
+		);
+		CREATE INDEX IF NOT EXISTS quest_claims_user_idx ON quest_claims(user_id);
+	`)
+	if err != nil { return err }
+	return addColumnSQLite(db, "quest_claims", "expire_error", "TEXT")
+}
+
+//the legacy "default" scope is full access, granular logins need tasks:write
+func canWriteTasks(scope string) bool {
+	for _, sc := range strings.Fields(scope) {
+		if sc == "default" || sc == "tasks:write" { return true }
+	}
+	return false
+}
+
+func (s *server) mountClaims(mux *http.ServeMux) {
+	mux.HandleFunc("POST /quests/{id}/claim", s.handleClaim)
+	mux.HandleFunc("POST /quests/{id}/unclaim", s.handleUnclaim)
+}
+
+//POST /quests/{id}/claim
+func (s *server) handleClaim(w http.ResponseWriter, r *http.Request) {
+	t, err := s.tokensForRequest(r)
+	if err != nil { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+
+	q, err := s.claimQuest(r.Context(), t, r.PathValue("id"))
+	if err != nil { writeClaimError(w, err); return }
+	writeJSON(w, q)
+}
+
+//POST /quests/{id}/unclaim
+func (s *server) handleUnclaim(w http.ResponseWriter, r *http.Request) {
+	t, err := s.tokensForRequest(r)
+	if err != nil { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+
+	q, err := s.unclaimQuest(r.Context(), t, t.UserID, r.PathValue("id"))
+	if err != nil { writeClaimError(w, err); return }
+	writeJSON(w, q)
+}
+
+func writeClaimError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errQuestNotFound):
+		http.Error(w, err.Error(), 404)
+	case errors.Is(err, errNoWriteScope), errors.Is(err, errNotClaimer):
+		http.Error(w, err.Error(), 403)
+	case errors.Is(err, errQuestDone), errors.Is(err, errQuestTaken), errors.Is(err, errClaimLimit):
+		http.Error(w, err.Error(), 409)
+	default:
+		http.Error(w, err.Error(), 502)
+	}
+}
+
+//assigns the task to t's user in asana, then mirrors it. nothing is locked
+//during the asana call. the mirror rechecks the quest under its row lock and,
+//when someone else got there first, puts asana back the way they left it
+func (s *server) claimQuest(ctx context.Context, t *asanaTokens, questID string) (*quest, error) {
+	if !canWriteTasks(t.Scope) { return nil, errNoWriteScope }
+
+	q, err := readQuest(s.db, questID, "")
+	if err != nil { return nil, err }
+	if err := s.checkClaim(s.db, q, t.UserID); err != nil { return nil, err }
+
+	//already ours is fine, claiming twice just records the claim
+	assigned := q.AssigneeID == nil
+	if assigned {
+		if err := s.asanaPUT(ctx, t, "/tasks/"+questID, map[string]any{"assignee": t.UserID}, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.mirrorClaim(ctx, questID, t.UserID); err != nil {
+		if assigned { s.restoreAssignee(ctx, t, questID) }
+		return nil, err
+	}
+
+	q.AssigneeID = &t.UserID
+	s.publish("quest", t.UserID, map[string]any{"quest_id": questID, "claimed_by": t.UserID})
+	return q, nil
+}
+
+//whether userID may claim q as it stands
+func (s *server) checkClaim(db querier, q *quest, userID string) error {
+	if q.Completed { return errQuestDone }
+	if q.AssigneeID != nil && *q.AssigneeID != userID { return errQuestTaken }
+	if s.cfg.ClaimLimit > 0 {
+		var n int
+		err := db.QueryRow(`select count(*) from quest_claims where user_id=$1 and quest_id<>$2`, userID, q.ID).Scan(&n)
+		if err != nil { return err }
+		if n >= s.cfg.ClaimLimit { return errClaimLimit }
+	}
+	return nil
+}
+
+func (s *server) mirrorClaim(ctx context.Context, questID, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	q, err := s.lockQuest(tx, questID)
+	if err != nil { return err }
+	if err := s.checkClaim(tx, q, userID); err != nil { return err }
+	if _, err := tx.Exec(`update quests set assignee_id=$2 where id=$1`, questID, userID); err != nil { return err }
+	_, err = tx.Exec(`insert into quest_claims(quest_id, user_id) values($1,$2)
+		on conflict (quest_id) do nothing`, questID, userID)
+	if err != nil { return err }
+	return tx.Commit()
+}
+
+//userID is whose claim is released, t is whose credential makes the asana call.
+//like claimQuest the mirror rechecks after asana answered
+func (s *server) unclaimQuest(ctx context.Context, t *asanaTokens, userID, questID string) (*quest, error) {
+	q, err := readQuest(s.db, questID, "")
+	if err != nil { return nil, err }
+	if err := checkUnclaim(q, userID); err != nil { return nil, err }
+	if !canWriteTasks(t.Scope) { return nil, errNoWriteScope }
+
+	if err := s.asanaPUT(ctx, t, "/tasks/"+questID, map[string]any{"assignee": nil}, nil); err != nil {
+		return nil, err
+	}
+	if err := s.mirrorUnclaim(ctx, questID, userID); err != nil {
+		s.restoreAssignee(ctx, t, questID)
+		return nil, err
+	}
+
+	q.AssigneeID = nil
+	s.publish("quest", userID, map[string]any{"quest_id": questID, "unclaimed_by": userID})
+	return q, nil
+}
+
+func checkUnclaim(q *quest, userID string) error {
+	if q.AssigneeID == nil || *q.AssigneeID != userID { return errNotClaimer }
+	if q.Completed { return errQuestDone }
+	return nil
+}
+
+func (s *server) mirrorUnclaim(ctx context.Context, questID, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil { return err }
+	defer tx.Rollback()
+
+	q, err := s.lockQuest(tx, questID)
+	if err != nil { return err }
+	if err := checkUnclaim(q, userID); err != nil { return err }
+	if _, err := tx.Exec(`update quests set assignee_id=null where id=$1`, questID); err != nil { return err }
+	if _, err := tx.Exec(`delete from quest_claims where quest_id=$1`, questID); err != nil { return err }
+	return tx.Commit()
+}
+
+//after a claim or unclaim lost a race, hands the task in asana back to
+//whoever the board now has on it. a failure is only logged, the next sync
+//mirrors whatever asana ends up with
+func (s *server) restoreAssignee(ctx context.Context, t *asanaTokens, questID string) {
+	q, err := readQuest(s.db, questID, "")
+	if err == nil {
+		err = s.asanaPUT(ctx, t, "/tasks/"+questID, map[string]any{"assignee": q.AssigneeID}, nil)
+	}
+	if err != nil { logFrom(ctx).Warn("could not restore asana assignee", "quest_id", questID, "err", err) }
+}
+
+func (s *server) lockQuest(tx *sql.Tx, questID string) (*quest, error) {
+	return readQuest(tx, questID, s.cfg.forUpdate())
+}
+
+//lock is appended to the select, s.cfg.forUpdate() inside a transaction
+func readQuest(db querier, questID, lock string) (*quest, error) {
+	var q quest
+	err := db.QueryRow(`select id, name, difficulty, completed, completed_by, assignee_id, coalesce(state,'')
+		from quests where id=$1`+lock, questID).
+		Scan(&q.ID, &q.Name, &q.Difficulty, &q.Completed, &q.CompletedBy, &q.AssigneeID, &q.State)
+	if errors.Is(err, sql.ErrNoRows) { return nil, errQuestNotFound }
+	if err != nil { return nil, err }
+	return &q, nil
+}
+
+//hands idle claims back to the board. a claim is idle when the quest is
+//still open and neither it nor its claimer's work on it has moved for
+//CLAIM_EXPIRY: no claim, state change or activity since. stop and ctx as in syncLoop
+func (s *server) claimExpiryLoop(stop, ctx context.Context) {
+	if s.cfg.ClaimExpiry <= 0 { return }
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop.Done():
+			return
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if err := s.expireClaims(withRequestID(ctx, "claims-"+randomString(6))); err != nil && ctx.Err() == nil {
+			logFrom(ctx).Warn("claim expiry failed", "err", err)
+		}
+	}
+}
+
+func (s *server) expireClaims(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+		select c.quest_id, c.user_id from quest_claims c
+		join quests q on q.id = c.quest_id
+		where not q.completed and c.expire_error is null and c.claimed_at < $1
+		  and not exists(select 1 from quest_transitions t where t.quest_id = c.quest_id and t.at >= $1)
+		  and not exists(select 1 from activity a
+		    where a.quest_id = c.quest_id and a.user_id = c.user_id and a.created_at >= $1)`,
+		time.Now().Add(-s.cfg.ClaimExpiry))
+	if err != nil { return err }
+	type claim struct{ questID, userID string }
+	var idle []claim
+	for rows.Next() {
+		var c claim
+		if err := rows.Scan(&c.questID, &c.userID); err != nil { rows.Close(); return err }
+		idle = append(idle, c)
+	}
+	rows.Close()
+
+	for _, c := range idle {
+		t, err := s.tokensForUser(ctx, c.userID)
+		if err != nil {
+			//without their login fall back to the service identity
+			if t, err = s.serviceTokens(ctx); err != nil { return err }
+		}
+		_, err = s.unclaimQuest(ctx, t, c.userID, c.questID)
+		//asana won't let this credential touch the task, trying every minute won't change that
+		if isAsanaStatus(err, http.StatusForbidden) {
+			logFrom(ctx).Error("parked idle claim asana refused to release", "quest_id", c.questID, "user_id", c.userID, "err", err)
+			_, err = s.db.ExecContext(ctx, `update quest_claims set expire_error=$2 where quest_id=$1`, c.questID, err.Error())
+			if err != nil { return err }
+			continue
+		}
+		if err != nil {
+			logFrom(ctx).Warn("could not release idle claim", "quest_id", c.questID, "user_id", c.userID, "err", err)
+			continue
+		}
+		logFrom(ctx).Info("released idle claim", "quest_id", c.questID, "user_id", c.userID)
+	}
+	return nil
+}
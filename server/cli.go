@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `usage: quest-api <command> [flags]
+
+commands:
+  serve                                  run the http api (default)
+  migrate                                create or update tables
+  sync [--project GID] [--as USER]       pull a project's tasks, as USER's asana login or the service identity
+  recompute --user USER | --all          rebuild scores from quests and grants
+            [--source quests|ledger] [--dry-run] [--batch N [--resume]]   (with --all)
+  season close [--name NAME]             archive the current season's standings and open the next
+  grant --user USER --points N --reason  add or remove points by hand
+  guild --id ID --name NAME USER...      create a guild or replace its name and members
+  export leaderboard|quests|ledger       write an export to stdout (--from --to --board --season)
+  config print                           show the loaded config with secrets redacted
+`
+
+//runs one subcommand of the binary, everything but serve and migrate
+//expects the schema to already exist
+func runCommand(cfg config, cmd string, args []string) error {
+	switch cmd {
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	case "config":
+		if len(args) == 0 || args[0] != "print" { return errors.New("usage: config print") }
+		if err := cfg.print(os.Stdout); err != nil { return err }
+		if err := cfg.validate(true); err != nil { return fmt.Errorf("config is not valid for serve:\n%w", err) }
+		return nil
+	}
+
+	if err := cfg.validate(cmd == "serve"); err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	db, err := openDB(cfg.DatabaseURL)
+	if err != nil { return err }
+	defer db.Close()
+
+	switch cmd {
+	case "serve":
+		if err := migrate(db, cfg.migrations()); err != nil { return err }
+		return newServer(db, cfg, newSQLStore(db)).serve()
+	case "migrate":
+		if err := migrate(db, cfg.migrations()); err != nil { return err }
+		fmt.Println("migrations applied")
+		return nil
+	}
+	if cfg.sqlite() { return fmt.Errorf("%s needs postgres, on sqlite only serve and migrate work so far", cmd) }
+
+	s := newServer(db, cfg, newSQLStore(db))
+	defer s.drainJobs()
+	switch cmd {
+	case "sync":
+		return s.cmdSync(args)
+	case "recompute":
+		return s.cmdRecompute(args)
+	case "season":
+		return s.cmdSeason(args)
+	case "grant":
+		return s.cmdGrant(args)
+	case "guild":
+		return s.cmdGuild(args)
+	case "export":
+		return s.cmdExport(args)
+	}
+	fmt.Fprint(os.Stderr, usage)
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+//gives notifications queued by a command a chance to go out before exit
+func (s *server) drainJobs() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := s.jobs.Wait(ctx); err != nil { fmt.Fprintln(os.Stderr, err) }
+}
+
+func (s *server) cmdSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	project := fs.String("project", s.cfg.AsanaProjectID, "asana project gid")
+	as := fs.String("as", "", "user gid whose asana login is used, default is the service identity")
+	fs.Parse(args)
+	if *project == "" {
+		return errors.New("sync needs --project")
+	}
+
+	var t *asanaTokens
+	var err error
+	if *as != "" {
+		t, err = s.tokensForUser(context.Background(), *as)
+		if err != nil { return fmt.Errorf("no asana login for %s: %w", *as, err) }
+	} else {
+		t, err = s.serviceTokens(context.Background())
+		if err != nil { return err }
+	}
+	ctx := withRequestID(context.Background(), "cli-"+randomString(6))
+	completers, err := s.syncProject(ctx, t, *project)
+	if err != nil { return err }
+	for _, uid := range completers {
+		if err := s.rescoreUser(uid); err != nil { return err }
+	}
+	fmt.Printf("synced project %s, %d new completions\n", *project, len(completers))
+	return nil
+}
+
+func (s *server) cmdRecompute(args []string) error {
+	fs := flag.NewFlagSet("recompute", flag.ExitOnError)
+	user := fs.String("user", "", "user gid")
+	all := fs.Bool("all", false, "every user")
+	source := fs.String("source", "quests", "quests (current weights) or ledger (points as awarded)")
+	dryRun := fs.Bool("dry-run", false, "print rank changes without writing")
+	batch := fs.Int("batch", 0, "commit this many users per transaction, 0 for one transaction")
+	resume := fs.Bool("resume", false, "continue an interrupted batched run")
+	fs.Parse(args)
+
+	switch {
+	case *all:
+		return s.recomputeAll(recomputeOpts{
+			source: *source,
+			dryRun: *dryRun,
+			batch:  *batch,
+			resume: *resume,
+		}, os.Stdout)
+	case *user != "":
+		if err := s.rescoreUser(*user); err != nil { return err }
+		row, rank, err := s.userStanding(*user)
+		if err != nil { return err }
+		fmt.Printf("%s has %g pts (#%d)\n", row.Name, row.Points, rank)
+		return nil
+	}
+	return errors.New("recompute needs --user or --all")
+}
+
+func (s *server) cmdSeason(args []string) error {
+	if len(args) == 0 || args[0] != "close" {
+		return errors.New("usage: season close [--name]")
+	}
+	fs := flag.NewFlagSet("season close", flag.ExitOnError)
+	name := fs.String("name", "", `name of the season that opens, default "Season N"`)
+	fs.Parse(args[1:])
+
+	next, standings, err := s.closeSeason(*name)
+	if err != nil { return err }
+	for _, st := range standings {
+		fmt.Printf("#%-3d %-24s %g pts\n", st.Rank, st.Name, st.Points)
+	}
+	fmt.Printf("season closed with %d players placed, %s (id %d) is open\n", len(standings), next.Name, next.ID)
+	return nil
+}
+
+func (s *server) cmdGrant(args []string) error {
+	fs := flag.NewFlagSet("grant", flag.ExitOnError)
+	user := fs.String("user", "", "user gid")
+	points := fs.Float64("points", 0, "points to add, negative to take away")
+	reason := fs.String("reason", "", "why, shows up in the ledger")
+	fs.Parse(args)
+	if *user == "" || *points == 0 || *reason == "" {
+		return errors.New("grant needs --user, --points and --reason")
+	}
+
+	if err := s.grantPoints(*user, *points, *reason); err != nil { return err }
+	row, rank, err := s.userStanding(*user)
+	if err != nil { return err }
+	fmt.Printf("%s now has %g pts (#%d)\n", row.Name, row.Points, rank)
+	return nil
+}
+
+func (s *server) cmdGuild(args []string) error {
+	fs := flag.NewFlagSet("guild", flag.ExitOnError)
+	id := fs.String("id", "", "guild id")
+	name := fs.String("name", "", "display name")
+	fs.Parse(args)
+	if *id == "" || *name == "" {
+		return errors.New("usage: guild --id ID --name NAME USER...")
+	}
+
+	g, err := s.setGuild(*id, *name, fs.Args())
+	if err != nil { return err }
+	fmt.Printf("%s (%s) has %d members\n", g.Name, g.ID, g.Members)
+	return nil
+}
+
+func (s *server) cmdExport(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: export leaderboard|quests|ledger [--from --to --board --season]")
+	}
+	what := args[0]
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	from := fs.String("from", "", "YYYY-MM-DD or RFC3339")
+	to := fs.String("to", "", "YYYY-MM-DD or RFC3339, exclusive")
+	board := fs.String("board", "", "asana project gid")
+	season := fs.String("season", "", "season id or current, instead of --from and --to")
+	fs.Parse(args[1:])
+
+	f, err := s.parseExportFilter(map[string][]string{"from": {*from}, "to": {*to}, "board": {*board}, "season": {*season}})
+	if err != nil { return err }
+	switch what {
+	case "leaderboard":
+		return s.exportLeaderboardCSV(os.Stdout, f)
+	case "quests":
+		return s.exportQuestsCSV(os.Stdout, f)
+	case "ledger":
+		return s.exportLedgerNDJSON(os.Stdout, f)
+	}
+	return fmt.Errorf("unknown export %q", what)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+func (s *server) mountComplete(mux *http.ServeMux) {
+	mux.HandleFunc("POST /quests/{id}/complete", s.handleComplete)
+}
+
+//POST /quests/{id}/complete
+//marks the task done in asana for the assignee and scores it right away,
+//calling it again after success returns the quest and pays anything an
+//earlier call left owed
+func (s *server) handleComplete(w http.ResponseWriter, r *http.Request) {
+	t, err := s.tokensForRequest(r)
+	if err != nil { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+
+	q, err := s.completeQuest(r.Context(), t, r.PathValue("id"))
+	if err != nil { writeClaimError(w, err); return }
+	writeJSON(w, q)
+}
+
+//asana is told first, with no lock held. the mirror then rechecks under the
+//row lock, and a quest that was reassigned meanwhile is reopened in asana
+func (s *server) completeQuest(ctx context.Context, t *asanaTokens, questID string) (*quest, error) {
+	q, err := readQuest(s.db, questID, "")
+	if err != nil { return nil, err }
+	//already done by the caller is a retry, it still goes through the award
+	//below so anything owed from an earlier failed call gets paid
+	wasDone := q.Completed
+	if err := checkComplete(q, t.UserID); err != nil { return nil, err }
+	if !wasDone {
+		if !canWriteTasks(t.Scope) { return nil, errNoWriteScope }
+		if err := s.asanaPUT(ctx, t, "/tasks/"+questID, map[string]any{"completed": true}, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	awarded, moved, err := s.mirrorComplete(ctx, t.UserID, questID)
+	if err != nil {
+		if !wasDone && !errors.Is(err, errQuestDone) {
+			if err := s.asanaPUT(ctx, t, "/tasks/"+questID, map[string]any{"completed": false}, nil); err != nil {
+				logFrom(ctx).Warn("could not reopen asana task", "quest_id", questID, "err", err)
+			}
+		}
+		return nil, err
+	}
+	s.announce(awarded...)
+
+	q.Completed, q.CompletedBy, q.State = true, &t.UserID, stateDone
+	if moved {
+		if err := s.afterTransition(questID, &t.UserID, stateDone); err != nil { return nil, err }
+	}
+	if err := s.rescoreUser(t.UserID); err != nil { return nil, err }
+	return q, nil
+}
+
+//done by userID is fine, that's a retry
+func checkComplete(q *quest, userID string) error {
+	if q.Completed {
+		if q.CompletedBy == nil || *q.CompletedBy != userID { return errQuestDone }
+		return nil
+	}
+	if q.AssigneeID == nil || *q.AssigneeID != userID { return errNotClaimer }
+	return nil
+}
+
+//marks the quest done by userID unless a sync already did, and pays for it.
+//moved is whether this call did the marking
+func (s *server) mirrorComplete(ctx context.Context, userID, questID string) ([]activityEvent, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil { return nil, false, err }
+	defer tx.Rollback()
+
+	q, err := s.lockQuest(tx, questID)
+	if err != nil { return nil, false, err }
+	if err := checkComplete(q, userID); err != nil { return nil, false, err }
+	moved := !q.Completed
+	if moved {
+		//sync overwrites completed_at with asana's own timestamp later
+		_, err = tx.Exec(`update quests set completed=true, completed_by=$2, completed_at=$3, state=$4 where id=$1`,
+			questID, userID, time.Now(), stateDone)
+		if err != nil { return nil, false, err }
+		if _, err := tx.Exec(`delete from quest_claims where quest_id=$1`, questID); err != nil { return nil, false, err }
+		if err := recordTransition(tx, questID, &userID, q.State, stateDone); err != nil { return nil, false, err }
+	}
+	awarded, err := s.awardCompletion(tx, questID, userID, q.Difficulty, "board")
+	if err != nil { return nil, false, err }
+	if err := tx.Commit(); err != nil { return nil, false, err }
+	return awarded, moved, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//everything the binary reads from its environment. defaults are
+//overridden by CONFIG_FILE (yaml), then by env vars and .env.api
+type config struct {
+	DatabaseURL       string `yaml:"database_url" env:"DATABASE_URL" secret:"true"`
+	Port              string `yaml:"api_port" env:"API_PORT"`
+	PublicAPIURL      string `yaml:"public_api_url" env:"PUBLIC_API_URL"`
+	PostLoginRedirect string `yaml:"post_login_redirect" env:"POST_LOGIN_REDIRECT"`
+
+	//comma separated, exact origins or https://*.example.com
+	CORSOrigins      []string      `yaml:"cors_origins" env:"CORS_ORIGIN"`
+	CORSMaxAge       time.Duration `yaml:"cors_max_age" env:"CORS_MAX_AGE"`
+	CookieSecure     bool          `yaml:"cookie_secure" env:"COOKIE_SECURE"`
+	CookieDomain     string        `yaml:"cookie_domain" env:"COOKIE_DOMAIN"`
+	CookieSameSite   string        `yaml:"cookie_same_site" env:"COOKIE_SAME_SITE"`
+	CookieHostPrefix bool          `yaml:"cookie_host_prefix" env:"COOKIE_HOST_PREFIX"`
+
+	AsanaProjectID    string `yaml:"asana_project_id" env:"ASANA_PROJECT_ID"`
+	AsanaClientID     string `yaml:"asana_client_id" env:"ASANA_CLIENT_ID"`
+	AsanaClientSecret string `yaml:"asana_client_secret" env:"ASANA_CLIENT_SECRET" secret:"true"`
+	AsanaRedirectURI  string `yaml:"asana_redirect_uri" env:"ASANA_REDIRECT_URI"`
+	AsanaScopes       string `yaml:"asana_scopes" env:"ASANA_SCOPES"`
+
+	//service identity for background sync, a PAT or the stored oauth login
+	//of a designated user. the PAT wins when both are set
+	AsanaPAT         string        `yaml:"asana_personal_access_token" env:"ASANA_PERSONAL_A_TOKEN" secret:"true"`
+	AsanaServiceUser string        `yaml:"asana_service_user" env:"ASANA_SERVICE_USER"`
+	SyncInterval     time.Duration `yaml:"sync_interval" env:"SYNC_INTERVAL"`
+	//have asana post project changes to PUBLIC_API_URL/asana/webhook, which has
+	//to be reachable from the internet. polling stays on as the fallback
+	AsanaWebhooks bool `yaml:"asana_webhooks" env:"ASANA_WEBHOOKS"`
+
+	//claiming from the board, 0 turns the limit or the expiry off
+	ClaimLimit  int           `yaml:"claim_limit" env:"CLAIM_LIMIT"`
+	ClaimExpiry time.Duration `yaml:"claim_expiry" env:"CLAIM_EXPIRY"`
+
+	//due date scoring. multipliers of 1 and a zero half-life leave points alone
+	ScoreOnTime       float64       `yaml:"score_on_time_multiplier" env:"SCORE_ON_TIME_MULTIPLIER"`
+	ScoreEarly        float64       `yaml:"score_early_multiplier" env:"SCORE_EARLY_MULTIPLIER"`
+	ScoreEarlyBy      time.Duration `yaml:"score_early_by" env:"SCORE_EARLY_BY"`
+	ScoreLateHalfLife time.Duration `yaml:"score_late_half_life" env:"SCORE_LATE_HALF_LIFE"`
+	ScoreLateFloor    float64       `yaml:"score_late_floor" env:"SCORE_LATE_FLOOR"`
+
+	//xp for moving a quest into review, paid once per quest, 0 is off
+	ReviewXP float64 `yaml:"review_xp" env:"REVIEW_XP"`
+
+	//asana gids allowed to use and issue admin scoped tokens
+	AdminUserIDs []string `yaml:"admin_user_ids" env:"ADMIN_USER_IDS"`
+
+	LogFormat string `yaml:"log_format" env:"LOG_FORMAT"`
+	LogLevel  string `yaml:"log_level" env:"LOG_LEVEL"`
+
+	ReadHeaderTimeout time.Duration `yaml:"http_read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"http_read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"http_write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"http_idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	SyncStaleAfter    time.Duration `yaml:"sync_stale_after" env:"SYNC_STALE_AFTER"`
+
+	NotifyWebhookURL string   `yaml:"notify_webhook_url" env:"NOTIFY_WEBHOOK_URL"`
+	SlackWebhookURL  string   `yaml:"slack_webhook_url" env:"SLACK_WEBHOOK_URL" secret:"true"`
+	SMTPAddr         string   `yaml:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPUser         string   `yaml:"smtp_user" env:"SMTP_USER"`
+	SMTPPass         string   `yaml:"smtp_pass" env:"SMTP_PASS" secret:"true"`
+	SMTPFrom         string   `yaml:"smtp_from" env:"SMTP_FROM"`
+	NotifyEmailTo    []string `yaml:"notify_email_to" env:"NOTIFY_EMAIL_TO"`
+	NotifyRoutes     string   `yaml:"notify_routes" env:"NOTIFY_ROUTES"`
+
+	SlackSigningSecret string `yaml:"slack_signing_secret" env:"SLACK_SIGNING_SECRET" secret:"true"`
+}
+
+func defaultConfig() config {
+	return config{
+		Port:              "8080",
+		CORSOrigins:       []string{"http://localhost:5173"},
+		CORSMaxAge:        10 * time.Minute,
+		CookieSameSite:    "lax",
+		PublicAPIURL:      "http://localhost:5173/api",
+		PostLoginRedirect: "http://localhost:5173/profile",
+		AsanaScopes:       "users:read",
+		LogFormat:         "json",
+		LogLevel:          "info",
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ShutdownTimeout:   30 * time.Second,
+		SyncStaleAfter:    time.Hour,
+		SyncInterval:      5 * time.Minute,
+		SMTPFrom:          "questboard@localhost",
+		ScoreOnTime:       1,
+		ScoreEarly:        1,
+		ScoreEarlyBy:      24 * time.Hour,
+	}
+}
+
+//reads defaults, then CONFIG_FILE if set, then env. only parse errors are
+//returned here, call validate for missing or inconsistent values
+func loadConfig() (config, error) {
+	cfg := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil { return cfg, fmt.Errorf("config file: %w", err) }
+		if err := yaml.Unmarshal(b, &cfg); err != nil { return cfg, fmt.Errorf("config file %s: %w", path, err) }
+	}
+
+	var errs []error
+	v := reflect.ValueOf(&cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		raw, ok := os.LookupEnv(f.Tag.Get("env"))
+		if !ok || raw == "" { continue }
+		if err := setField(v.Field(i), raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Tag.Get("env"), err))
+		}
+	}
+	return cfg, errors.Join(errs...)
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(raw)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil { return err }
+		field.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil { return err }
+		field.SetFloat(f)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil { return err }
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil { return err }
+		field.Set(reflect.ValueOf(d))
+	case []string:
+		var list []string
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" { list = append(list, s) }
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return errors.New("unsupported config type " + field.Type().String())
+	}
+	return nil
+}
+
+//everything wrong with the config at once. forServe also requires what
+//only the http api needs, like the oauth client
+func (c config) validate(forServe bool) error {
+	var errs []error
+	need := func(v, name string) {
+		if v == "" { errs = append(errs, errors.New(name+" is required")) }
+	}
+	isURL := func(v, name string) {
+		if v == "" { return }
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s must be an http(s) url, got %q", name, v))
+		}
+	}
+
+	need(c.DatabaseURL, "DATABASE_URL")
+	if p, ok := sqlitePath(c.DatabaseURL); ok && p == "" {
+		errs = append(errs, errors.New("DATABASE_URL sqlite: needs a file path, like sqlite:questboard.db"))
+	}
+	if forServe {
+		need(c.AsanaClientID, "ASANA_CLIENT_ID")
+		need(c.AsanaClientSecret, "ASANA_CLIENT_SECRET")
+		need(c.AsanaRedirectURI, "ASANA_REDIRECT_URI")
+		need(c.AsanaProjectID, "ASANA_PROJECT_ID")
+		if _, err := strconv.Atoi(c.Port); err != nil {
+			errs = append(errs, fmt.Errorf("API_PORT must be a number, got %q", c.Port))
+		}
+	}
+	isURL(c.AsanaRedirectURI, "ASANA_REDIRECT_URI")
+	for _, o := range c.CORSOrigins {
+		//wildcards stand for one or more subdomain labels, https://*.example.com
+		isURL(strings.Replace(o, "*.", "x.", 1), "CORS_ORIGIN")
+	}
+	switch c.CookieSameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.CookieSecure { errs = append(errs, errors.New("COOKIE_SAME_SITE=none needs COOKIE_SECURE=true")) }
+	default:
+		errs = append(errs, fmt.Errorf("COOKIE_SAME_SITE must be lax, strict or none, got %q", c.CookieSameSite))
+	}
+	if c.CookieHostPrefix && (!c.CookieSecure || c.CookieDomain != "") {
+		errs = append(errs, errors.New("COOKIE_HOST_PREFIX needs COOKIE_SECURE=true and no COOKIE_DOMAIN"))
+	}
+	isURL(c.PublicAPIURL, "PUBLIC_API_URL")
+	isURL(c.PostLoginRedirect, "POST_LOGIN_REDIRECT")
+	isURL(c.NotifyWebhookURL, "NOTIFY_WEBHOOK_URL")
+	isURL(c.SlackWebhookURL, "SLACK_WEBHOOK_URL")
+
+	switch c.LogFormat {
+	case "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be json or text, got %q", c.LogFormat))
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+
+	for name, d := range map[string]time.Duration{
+		"HTTP_READ_HEADER_TIMEOUT": c.ReadHeaderTimeout,
+		"HTTP_READ_TIMEOUT":        c.ReadTimeout,
+		"HTTP_WRITE_TIMEOUT":       c.WriteTimeout,
+		"HTTP_IDLE_TIMEOUT":        c.IdleTimeout,
+		"SHUTDOWN_TIMEOUT":         c.ShutdownTimeout,
+		"SYNC_STALE_AFTER":         c.SyncStaleAfter,
+		"SYNC_INTERVAL":            c.SyncInterval,
+		"CORS_MAX_AGE":             c.CORSMaxAge,
+	} {
+		if d <= 0 { errs = append(errs, errors.New(name+" must be positive")) }
+	}
+	if c.ClaimLimit < 0 { errs = append(errs, errors.New("CLAIM_LIMIT can't be negative")) }
+	if c.ClaimExpiry < 0 { errs = append(errs, errors.New("CLAIM_EXPIRY can't be negative")) }
+	if c.ScoreOnTime <= 0 || c.ScoreEarly <= 0 {
+		errs = append(errs, errors.New("SCORE_ON_TIME_MULTIPLIER and SCORE_EARLY_MULTIPLIER must be positive"))
+	}
+	if c.ScoreEarlyBy < 0 || c.ScoreLateHalfLife < 0 {
+		errs = append(errs, errors.New("SCORE_EARLY_BY and SCORE_LATE_HALF_LIFE can't be negative"))
+	}
+	if c.ScoreLateFloor < 0 || c.ScoreLateFloor > 1 {
+		errs = append(errs, fmt.Errorf("SCORE_LATE_FLOOR must be between 0 and 1, got %v", c.ScoreLateFloor))
+	}
+	if c.ReviewXP < 0 { errs = append(errs, errors.New("REVIEW_XP can't be negative")) }
+
+	if c.SMTPAddr != "" {
+		if len(c.NotifyEmailTo) == 0 { errs = append(errs, errors.New("NOTIFY_EMAIL_TO is required when SMTP_ADDR is set")) }
+		for _, to := range c.NotifyEmailTo {
+			if _, err := mail.ParseAddress(to); err != nil {
+				errs = append(errs, fmt.Errorf("NOTIFY_EMAIL_TO has a bad address %q", to))
+			}
+		}
+	}
+	rules := map[string]bool{}
+	for _, r := range defaultNotifyRules() { rules[r.name] = true }
+	for rule, sinks := range parseNotifyRoutes(c.NotifyRoutes) {
+		if !rules[rule] { errs = append(errs, fmt.Errorf("NOTIFY_ROUTES has unknown rule %q", rule)) }
+		for _, sink := range sinks {
+			switch sink {
+			case "webhook", "slack", "email":
+			default:
+				errs = append(errs, fmt.Errorf("NOTIFY_ROUTES has unknown sink %q", sink))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c config) oauth() oauthConfig {
+	return oauthConfig{
+		clientID:     c.AsanaClientID,
+		clientSecret: c.AsanaClientSecret,
+		redirectURI:  c.AsanaRedirectURI,
+		scopes:       c.AsanaScopes,
+	}
+}
+
+//yaml with secrets masked, safe to paste into an issue
+func (c config) print(w io.Writer) error {
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		var val any = v.Field(i).Interface()
+		switch x := val.(type) {
+		case time.Duration:
+			val = x.String()
+		case string:
+			if f.Tag.Get("secret") == "true" && x != "" { val = "[redacted]" }
+		}
+		b, err := yaml.Marshal(map[string]any{f.Tag.Get("yaml"): val})
+		if err != nil { return err }
+		if _, err := w.Write(b); err != nil { return err }
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//which browser origins may call the api with credentials
+type corsPolicy struct {
+	exact    map[string]bool
+	suffixes []string // "https://*.example.com" kept as scheme "https://" + ".example.com"
+	schemes  []string
+	maxAge   int
+}
+
+func newCORSPolicy(origins []string, maxAgeSeconds int) *corsPolicy {
+	p := &corsPolicy{exact: map[string]bool{}, maxAge: maxAgeSeconds}
+	for _, o := range origins {
+		o = strings.TrimRight(o, "/")
+		if scheme, rest, ok := strings.Cut(o, "://*."); ok {
+			p.schemes = append(p.schemes, scheme+"://")
+			p.suffixes = append(p.suffixes, "."+rest)
+			continue
+		}
+		p.exact[o] = true
+	}
+	return p
+}
+
+func (p *corsPolicy) allowed(origin string) bool {
+	if origin == "" { return false }
+	if p.exact[origin] { return true }
+	for i, suffix := range p.suffixes {
+		host, ok := strings.CutPrefix(origin, p.schemes[i])
+		if ok && strings.HasSuffix(host, suffix) && !strings.ContainsAny(host, "/@") {
+			return true
+		}
+	}
+	return false
+}
+
+//echoes allowed origins back with credentials, everything else gets no
+//cors headers at all. preflights are answered here and cached by the browser
+func (p *corsPolicy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//the answer depends on Origin, caches must not share it across origins
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if p.allowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Next-Offset, X-Request-ID")
+			if preflight {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+			}
+		}
+		if preflight {
+			w.WriteHeader(http.StatusNoContent); return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSAllowed(t *testing.T) {
+	p := newCORSPolicy([]string{"https://quests.example.com/", "http://localhost:5173", "https://*.preview.example.com"}, 600)
+	cases := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://quests.example.com", true},
+		{"http://localhost:5173", true},
+		{"https://pr-12.preview.example.com", true},
+		{"https://a.b.preview.example.com", true},
+		{"", false},
+		{"null", false},
+		{"http://quests.example.com", false},
+		{"https://quests.example.com.evil.com", false},
+		{"http://localhost:5174", false},
+		{"http://pr-12.preview.example.com", false},
+		{"https://preview.example.com", false},
+		{"https://evilpreview.example.com", false},
+		{"https://evil.com/.preview.example.com", false},
+		{"https://user@x.preview.example.com", false},
+	}
+	for _, c := range cases {
+		if got := p.allowed(c.origin); got != c.ok { t.Errorf("allowed(%q) = %v, want %v", c.origin, got, c.ok) }
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	p := newCORSPolicy([]string{"http://localhost:5173"}, 600)
+	cases := []struct {
+		name, method, origin, reqMethod string
+		code                            int
+		allowOrigin, allowMethods       string
+		reachesNext                     bool
+	}{
+		{"preflight", "OPTIONS", "http://localhost:5173", "PUT", 204, "http://localhost:5173", "GET, POST, PUT, OPTIONS", false},
+		{"foreign preflight", "OPTIONS", "https://evil.example", "POST", 204, "", "", false},
+		{"plain options", "OPTIONS", "http://localhost:5173", "", 200, "http://localhost:5173", "", true},
+		{"allowed get", "GET", "http://localhost:5173", "", 200, "http://localhost:5173", "", true},
+		{"foreign get", "GET", "https://evil.example", "", 200, "", "", true},
+	}
+	for _, c := range cases {
+		reached := false
+		h := p.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+		r := httptest.NewRequest(c.method, "/api/quests", nil)
+		r.Header.Set("Origin", c.origin)
+		if c.reqMethod != "" { r.Header.Set("Access-Control-Request-Method", c.reqMethod) }
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.code || reached != c.reachesNext { t.Errorf("%s: code %d, reached %v", c.name, rec.Code, reached) }
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != c.allowOrigin { t.Errorf("%s: allow origin %q", c.name, got) }
+		if got := rec.Header().Get("Access-Control-Allow-Methods"); got != c.allowMethods { t.Errorf("%s: allow methods %q", c.name, got) }
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	h := csrfProtect(newCORSPolicy([]string{"https://quests.example.com"}, 0), "sid",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }))
+	cases := []struct {
+		name, method, path   string
+		origin, site, bearer string
+		cookie               bool
+		code                 int
+	}{
+		{"get from anywhere", "GET", "/api/quests", "https://evil.example", "cross-site", "", true, 204},
+		{"head", "HEAD", "/api/quests", "https://evil.example", "", "", true, 204},
+		{"allowed origin", "POST", "/api/claims", "https://quests.example.com", "", "", true, 204},
+		{"same host origin", "POST", "/api/claims", "http://api.example", "", "", true, 204},
+		{"cross origin", "POST", "/api/claims", "https://evil.example", "", "", true, 403},
+		{"cross origin put", "PUT", "/api/guilds/g1", "https://evil.example", "", "", true, 403},
+		{"null origin", "POST", "/api/claims", "null", "", "", true, 403},
+		{"same-origin fetch", "POST", "/api/claims", "", "same-origin", "", true, 204},
+		{"typed url", "POST", "/api/claims", "", "none", "", true, 204},
+		{"cross-site fetch", "POST", "/api/claims", "", "cross-site", "", true, 403},
+		{"same-site fetch", "POST", "/api/claims", "", "same-site", "", true, 403},
+		{"no browser headers", "POST", "/api/claims", "", "", "", true, 204},
+		{"bearer without cookie", "POST", "/api/kudos", "https://evil.example", "", "qb_x", false, 204},
+		{"bearer with cookie", "POST", "/api/kudos", "https://evil.example", "", "qb_x", true, 403},
+		{"slack command", "POST", "/api/integrations/slack/command", "https://evil.example", "cross-site", "", false, 204},
+		{"slack link", "POST", "/api/integrations/slack/link", "https://evil.example", "cross-site", "", true, 403},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "http://api.example"+c.path, nil)
+		if c.origin != "" { r.Header.Set("Origin", c.origin) }
+		if c.site != "" { r.Header.Set("Sec-Fetch-Site", c.site) }
+		if c.bearer != "" { r.Header.Set("Authorization", "Bearer "+c.bearer) }
+		if c.cookie { r.AddCookie(&http.Cookie{Name: "sid", Value: "s1"}) }
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.code { t.Errorf("%s: code %d, want %d", c.name, rec.Code, c.code) }
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+//one due date rule that changed a completion's points, kept in the
+//activity detail so players can see why a quest paid what it did
+type scoreModifier struct {
+	Name       string  `json:"name"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+func ensureDueDateTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		ALTER TABLE quests ADD COLUMN IF NOT EXISTS due_at TIMESTAMPTZ;
+		ALTER TABLE quests ADD COLUMN IF NOT EXISTS multiplier NUMERIC NOT NULL DEFAULT 1;
+	`)
+	return err
+}
+
+//asana sends due_at for tasks with a time and only due_on for whole days,
+//a whole day counts as due at the end of it (utc)
+func taskDueAt(t asanaTask) *time.Time {
+	if t.DueAt != nil { return t.DueAt }
+	if t.DueOn == "" { return nil }
+	d, err := time.Parse("2006-01-02", t.DueOn)
+	if err != nil { return nil }
+	d = d.Add(24 * time.Hour)
+	return &d
+}
+
+//rules that apply to a quest done at doneAt. rules left at their neutral
+//defaults never show up
+func (c config) dueModifiers(due *time.Time, doneAt time.Time) []scoreModifier {
+	mods := []scoreModifier{}
+	if due == nil { return mods }
+
+	if !doneAt.After(*due) {
+		if c.ScoreOnTime != 1 { mods = append(mods, scoreModifier{"on_time", c.ScoreOnTime}) }
+		if c.ScoreEarly != 1 && !doneAt.After(due.Add(-c.ScoreEarlyBy)) {
+			mods = append(mods, scoreModifier{"early", c.ScoreEarly})
+		}
+		return mods
+	}
+
+	//halves every half-life past due, down to the floor
+	if c.ScoreLateHalfLife > 0 {
+		late := doneAt.Sub(*due)
+		m := math.Max(c.ScoreLateFloor, math.Pow(0.5, late.Hours()/c.ScoreLateHalfLife.Hours()))
+		mods = append(mods, scoreModifier{"late", math.Round(m*1000) / 1000})
+	}
+	return mods
+}
+
+func totalMultiplier(mods []scoreModifier) float64 {
+	m := 1.0
+	for _, mod := range mods { m *= mod.Multiplier }
+	return m
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDueModifiers(t *testing.T) {
+	due := time.Date(2025, 6, 10, 0, 0, 0, 0, time.UTC)
+	neutral := defaultConfig()
+	tuned := defaultConfig()
+	tuned.ScoreOnTime, tuned.ScoreEarly, tuned.ScoreEarlyBy = 1.1, 1.5, 24*time.Hour
+	tuned.ScoreLateHalfLife, tuned.ScoreLateFloor = 48*time.Hour, 0.3
+	cases := []struct {
+		name string
+		cfg  config
+		due  *time.Time
+		done time.Time
+		want []scoreModifier
+	}{
+		{"no due date", tuned, nil, due, []scoreModifier{}},
+		{"neutral on time", neutral, &due, due.Add(-time.Hour), []scoreModifier{}},
+		{"neutral late", neutral, &due, due.Add(72 * time.Hour), []scoreModifier{}},
+		{"on time", tuned, &due, due.Add(-time.Hour), []scoreModifier{{"on_time", 1.1}}},
+		{"right at due", tuned, &due, due, []scoreModifier{{"on_time", 1.1}}},
+		{"early", tuned, &due, due.Add(-24 * time.Hour), []scoreModifier{{"on_time", 1.1}, {"early", 1.5}}},
+		{"one half-life late", tuned, &due, due.Add(48 * time.Hour), []scoreModifier{{"late", 0.5}}},
+		{"a day late", tuned, &due, due.Add(24 * time.Hour), []scoreModifier{{"late", 0.707}}},
+		{"at the floor", tuned, &due, due.Add(30 * 24 * time.Hour), []scoreModifier{{"late", 0.3}}},
+	}
+	for _, c := range cases {
+		got := c.cfg.dueModifiers(c.due, c.done)
+		if !reflect.DeepEqual(got, c.want) { t.Errorf("%s: %+v, want %+v", c.name, got, c.want) }
+	}
+	if m := totalMultiplier([]scoreModifier{{"on_time", 1.1}, {"early", 1.5}}); m < 1.649 || m > 1.651 { t.Errorf("total = %v", m) }
+}
+
+func TestTaskDueAt(t *testing.T) {
+	at := time.Date(2025, 6, 10, 15, 30, 0, 0, time.UTC)
+	cases := []struct {
+		name string
+		task asanaTask
+		want *time.Time
+	}{
+		{"no due date", asanaTask{}, nil},
+		{"due_at wins", asanaTask{DueAt: &at, DueOn: "2025-06-01"}, &at},
+		{"whole day", asanaTask{DueOn: "2025-06-10"}, ptrTime(time.Date(2025, 6, 11, 0, 0, 0, 0, time.UTC))},
+		{"garbage", asanaTask{DueOn: "soon"}, nil},
+	}
+	for _, c := range cases {
+		got := taskDueAt(c.task)
+		if (got == nil) != (c.want == nil) || got != nil && !got.Equal(*c.want) { t.Errorf("%s: %v, want %v", c.name, got, c.want) }
+	}
+}
+
+func ptrTime(t time.Time) *time.Time { return &t }
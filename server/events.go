@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//postgres channel every instance listens on
+const eventsChannel = "quest_events"
+
+type event struct {
+	Kind string `json:"kind"`
+	//whose activity it is and their profile visibility, empty for board wide
+	//events. subscribers that can't see the profile don't get the event
+	UserID     string `json:"user_id,omitempty"`
+	Visibility string `json:"visibility,omitempty"`
+	Data       any    `json:"data"`
+}
+
+func (ev event) seenBy(viewer string) bool {
+	return ev.UserID == "" || canSeeProfile(ev.Visibility, ev.UserID, viewer)
+}
+
+//in-process pub/sub, one buffered channel per open /events stream
+type hub struct {
+	mu     sync.Mutex
+	subs   map[chan event]struct{}
+	closed bool
+}
+
+func newHub() *hub {
+	return &hub{subs: map[chan event]struct{}{}}
+}
+
+//the channel is closed when the hub shuts down
+func (h *hub) subscribe() chan event {
+	ch := make(chan event, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+//ends every stream, used on shutdown
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		close(ch)
+		delete(h.subs, ch)
+	}
+}
+
+//slow clients drop events instead of blocking the scorer
+func (h *hub) broadcast(ev event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+//sends the event through postgres so every instance (this one included)
+//hands it to its subscribers, falls back to local only if notify fails.
+//on sqlite there is only this instance. outgoing notifications fire here so
+//only the originating instance sends them. userID is who the event is about,
+//"" when it isn't about anyone
+func (s *server) publish(kind, userID string, data any) {
+	s.publishEvent(kind, userID, data, true)
+}
+
+//notify false still streams the event but sends no outgoing notifications
+func (s *server) publishEvent(kind, userID string, data any, notify bool) {
+	ev := event{Kind: kind, UserID: userID, Data: data}
+	if userID != "" {
+		//hidden unless we can tell otherwise
+		ev.Visibility = visibilityPrivate
+		err := s.db.QueryRow(`select profile_visibility from users where id=$1`, userID).Scan(&ev.Visibility)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) { slog.Warn("event visibility", "user", userID, "err", err) }
+	}
+	//private users stay out of channels and webhooks as well
+	if notify && ev.Visibility != visibilityPrivate { s.notifier.dispatch(kind, data) }
+	if s.cfg.sqlite() { s.hub.broadcast(ev); return }
+	b, err := json.Marshal(ev)
+	if err == nil {
+		_, err = s.db.Exec(`select pg_notify($1, $2)`, eventsChannel, string(b))
+	}
+	if err != nil {
+		slog.Warn("publish via notify failed", "kind", kind, "err", err)
+		s.hub.broadcast(ev)
+	}
+}
+
+//relays NOTIFY payloads into the local hub, run once in its own goroutine
+func (s *server) listenEvents(dsn string) {
+	l := pq.NewListener(dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil { slog.Warn("events listener", "err", err) }
+	})
+	if err := l.Listen(eventsChannel); err != nil {
+		slog.Error("events listen failed", "err", err)
+		return
+	}
+	for {
+		select {
+		case n := <-l.Notify:
+			//nil after a reconnect, anything sent meanwhile is lost
+			if n == nil { continue }
+			var ev event
+			if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil { continue }
+			s.hub.broadcast(ev)
+		case <-time.After(90 * time.Second):
+			go l.Ping()
+		}
+	}
+}
+
+func (s *server) mountEvents(mux *http.ServeMux) {
+	mux.HandleFunc("GET /events", s.handleEvents)
+}
+
+//GET /events
+//server-sent events: leaderboard deltas, quest completions, rank-ups and badges
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	viewer, ok := s.requireScope(w, r, scopeReadLeaderboard)
+	if !ok { return }
+
+	flusher, ok := w.(http.Flusher)
+	if !ok { http.Error(w, "streaming unsupported", 500); return }
+	//the server write timeout would cut the stream off
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := s.hub.subscribe()
+	defer s.hub.unsubscribe(ch)
+
+	//comment lines keep proxies from closing an idle stream
+	heartbeat := time.NewTicker(25 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case ev, ok := <-ch:
+			if !ok { return }
+			if !ev.seenBy(viewer) { continue }
+			b, err := json.Marshal(ev.Data)
+			if err != nil { continue }
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, b)
+			flusher.Flush()
+		}
+	}
+}
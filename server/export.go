@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func (s *server) mountExport(mux *http.ServeMux) {
+	mux.HandleFunc("GET /export/leaderboard.csv", s.handleExportLeaderboard)
+	mux.HandleFunc("GET /export/quests.csv", s.handleExportQuests)
+	mux.HandleFunc("GET /export/ledger.ndjson", s.handleExportLedger)
+}
+
+//shared ?from=&to=&board=&season= filters, dates are YYYY-MM-DD or RFC3339, to is
+//exclusive. season is an id or current and stands for that season's date range
+type exportFilter struct {
+	from, to *time.Time
+	board    *string
+	//whose profile rules apply, nil from the cli which sees everyone
+	viewer *string
+}
+
+func (s *server) parseExportFilter(q url.Values) (exportFilter, error) {
+	f, err := parseExportDates(q)
+	if err != nil || q.Get("season") == "" { return f, err }
+	if f.from != nil || f.to != nil { return f, errors.New("season can't be combined with from or to") }
+	se, err := s.seasonByRef(q.Get("season"))
+	if err != nil { return f, err }
+	f.from, f.to = &se.StartedAt, se.EndedAt
+	return f, nil
+}
+
+func parseExportDates(q url.Values) (exportFilter, error) {
+	var f exportFilter
+	parse := func(v string) (*time.Time, error) {
+		if v == "" { return nil, nil }
+		if t, err := time.Parse(time.DateOnly, v); err == nil { return &t, nil }
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil { return nil, errors.New("bad date " + v) }
+		return &t, nil
+	}
+	var err error
+	if f.from, err = parse(q.Get("from")); err != nil { return f, err }
+	if f.to, err = parse(q.Get("to")); err != nil { return f, err }
+	if v := q.Get("board"); v != "" { f.board = &v }
+	return f, nil
+}
+
+func (f exportFilter) any() bool { return f.from != nil || f.to != nil || f.board != nil }
+
+//users the viewer can't open a profile for stay out of the export
+func (f exportFilter) hides(visibility, id string) bool {
+	return f.viewer != nil && !canSeeProfile(visibility, id, *f.viewer)
+}
+
+//the filters in use, the date range applies to the time column at
+func (f exportFilter) where(at string) whereClause {
+	var wc whereClause
+	if f.from != nil { wc.add(at+" >= ?", *f.from) }
+	if f.to != nil { wc.add(at+" < ?", *f.to) }
+	if f.board != nil { wc.add("q.project_id = ?", *f.board) }
+	return wc
+}
+
+//parses filters and checks the session, writes the error itself
+func (s *server) exportPrelude(w http.ResponseWriter, r *http.Request) (exportFilter, bool) {
+	userID, ok := s.requireScope(w, r, scopeReadLeaderboard)
+	if !ok { return exportFilter{}, false }
+	f, err := s.parseExportFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return f, false
+	}
+	f.viewer = &userID
+	//big histories can take longer than the server write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	return f, true
+}
+
+//remembers whether the body has started, so a failure before the first byte
+//can still be a plain 500 and one after it is marked at the end of the file
+type exportWriter struct {
+	http.ResponseWriter
+	n    int
+	last byte
+}
+
+func (ew *exportWriter) Write(p []byte) (int, error) {
+	n, err := ew.ResponseWriter.Write(p)
+	if n > 0 { ew.n += n; ew.last = p[n-1] }
+	return n, err
+}
+
+//record writes the trailer that tells a reader the file is incomplete, it
+//starts on a line of its own
+func (ew *exportWriter) fail(r *http.Request, err error, record func(io.Writer, string)) {
+	logFrom(r.Context()).Error("export failed", "path", r.URL.Path, "sent", ew.n, "err", err)
+	if ew.n == 0 {
+		ew.Header().Del("Content-Disposition")
+		http.Error(ew.ResponseWriter, err.Error(), 500)
+		return
+	}
+	if ew.last != '\n' { io.WriteString(ew, "\n") }
+	record(ew, err.Error())
+}
+
+func csvTrailer(w io.Writer, msg string) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"#error", msg})
+	cw.Flush()
+}
+
+func ndjsonTrailer(w io.Writer, msg string) {
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func csvHeaders(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+}
+
+//GET /export/leaderboard.csv
+//without filters this is the scores table, with filters points are summed from activity in range.
+//hidden users are left out but keep their place in the ranking. a csv export
+//that fails part way ends with a "#error,<message>" row
+func (s *server) handleExportLeaderboard(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.exportPrelude(w, r)
+	if !ok { return }
+	csvHeaders(w, "leaderboard.csv")
+	ew := &exportWriter{ResponseWriter: w}
+	if err := s.exportLeaderboardCSV(ew, f); err != nil { ew.fail(r, err, csvTrailer) }
+}
+
+func (s *server) exportLeaderboardCSV(w io.Writer, f exportFilter) error {
+	query := `
+		select rank() over (order by coalesce(sc.points,0) desc), u.id, u.name, coalesce(sc.points,0), u.profile_visibility
+		from users u
+		left join scores sc on sc.user_id = u.id
+		order by 1, u.name`
+	var args []any
+	if f.any() {
+		wc := f.where("a.created_at")
+		query = `
+			with earned as (
+			  select a.user_id, sum(a.points) as points
+			  from activity a
+			  left join quests q on q.id = a.quest_id
+			  ` + wc.sql() + `
+			  group by a.user_id
+			)
+			select rank() over (order by coalesce(e.points,0) desc), u.id, u.name, coalesce(e.points,0), u.profile_visibility
+			from users u
+			left join earned e on e.user_id = u.id
+			order by 1, u.name`
+		args = wc.args
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil { return err }
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"rank", "user_id", "name", "points"})
+	for rows.Next() {
+		var rank int
+		var id, name, visibility string
+		var points float64
+		if err := rows.Scan(&rank, &id, &name, &points, &visibility); err != nil { return err }
+		if f.hides(visibility, id) { continue }
+		cw.Write([]string{strconv.Itoa(rank), id, name, strconv.FormatFloat(points, 'f', -1, 64)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil { return err }
+	return rows.Err()
+}
+
+//GET /export/quests.csv
+//date range applies to completed_at, completers the caller can't see are blanked
+func (s *server) handleExportQuests(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.exportPrelude(w, r)
+	if !ok { return }
+	csvHeaders(w, "quests.csv")
+	ew := &exportWriter{ResponseWriter: w}
+	if err := s.exportQuestsCSV(ew, f); err != nil { ew.fail(r, err, csvTrailer) }
+}
+
+func (s *server) exportQuestsCSV(w io.Writer, f exportFilter) error {
+	wc := f.where("q.completed_at")
+	rows, err := s.db.Query(`
+		select q.id, q.name, q.difficulty, q.completed, coalesce(q.completed_by,''), coalesce(u.name,''),
+		       q.completed_at, coalesce(q.project_id,''), coalesce(u.profile_visibility,'public')
+		from quests q
+		left join users u on u.id = q.completed_by
+		`+wc.sql()+`
+		order by q.completed_at nulls last, q.name`, wc.args...)
+	if err != nil { return err }
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name", "difficulty", "completed", "completed_by", "completed_by_name", "completed_at", "board"})
+	for rows.Next() {
+		var id, name, difficulty, by, byName, board, visibility string
+		var completed bool
+		var at *time.Time
+		if err := rows.Scan(&id, &name, &difficulty, &completed, &by, &byName, &at, &board, &visibility); err != nil { return err }
+		if f.hides(visibility, by) { by, byName = "", "" }
+		when := ""
+		if at != nil { when = at.Format(time.RFC3339) }
+		cw.Write([]string{id, name, difficulty, strconv.FormatBool(completed), by, byName, when, board})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil { return err }
+	return rows.Err()
+}
+
+//GET /export/ledger.ndjson
+//every activity row that moved points, one json object per line, without the
+//rows of users the caller can't see. a failure part way ends the stream with
+//an {"error": ...} line
+func (s *server) handleExportLedger(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.exportPrelude(w, r)
+	if !ok { return }
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="ledger.ndjson"`)
+	ew := &exportWriter{ResponseWriter: w}
+	if err := s.exportLedgerNDJSON(ew, f); err != nil { ew.fail(r, err, ndjsonTrailer) }
+}
+
+func (s *server) exportLedgerNDJSON(w io.Writer, f exportFilter) error {
+	wc := f.where("a.created_at")
+	if f.viewer != nil { wc.visibleTo(*f.viewer) }
+	rows, err := s.db.Query(`
+		select a.id, a.kind, a.user_id, a.quest_id, a.points, a.detail, a.created_at
+		from activity a
+		join users u on u.id = a.user_id
+		left join quests q on q.id = a.quest_id
+		`+wc.sql()+` and a.points <> 0
+		order by a.id`, wc.args...)
+	if err != nil { return err }
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		var it activityItem
+		var detail []byte
+		if err := rows.Scan(&it.ID, &it.Kind, &it.UserID, &it.QuestID, &it.Points, &detail, &it.CreatedAt); err != nil { return err }
+		err := enc.Encode(map[string]any{
+			"id":         it.ID,
+			"kind":       it.Kind,
+			"user_id":    it.UserID,
+			"quest_id":   it.QuestID,
+			"points":     it.Points,
+			"detail":     json.RawMessage(detail),
+			"created_at": it.CreatedAt,
+		})
+		if err != nil { return err }
+	}
+	return rows.Err()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExportWriterFail(t *testing.T) {
+	boom := errors.New("boom")
+	cases := []struct {
+		name, sent string
+		record     func(io.Writer, string)
+		code       int
+		body       string
+	}{
+		{"before the body", "", csvTrailer, 500, "boom\n"},
+		{"after whole rows", "rank,user_id\n1,U1\n", csvTrailer, 200, "rank,user_id\n1,U1\n#error,boom\n"},
+		{"mid row", "rank,user_id\n1,U", csvTrailer, 200, "rank,user_id\n1,U\n#error,boom\n"},
+		{"ndjson", "{\"id\":1}\n", ndjsonTrailer, 200, "{\"id\":1}\n{\"error\":\"boom\"}\n"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		csvHeaders(rec, "leaderboard.csv")
+		ew := &exportWriter{ResponseWriter: rec}
+		if c.sent != "" { io.WriteString(ew, c.sent) }
+		ew.fail(httptest.NewRequest("GET", "/export/leaderboard.csv", nil), boom, c.record)
+		if rec.Code != c.code || rec.Body.String() != c.body { t.Errorf("%s: %d %q, want %d %q", c.name, rec.Code, rec.Body, c.code, c.body) }
+		if c.code == 500 && rec.Header().Get("Content-Disposition") != "" { t.Errorf("%s: error sent as an attachment", c.name) }
+	}
+}
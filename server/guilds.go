@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+//teams of players, only used to filter the activity feed for now
+type guild struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+var errUnknownMember = errors.New("unknown user")
+
+//plain text columns, the same sql runs on postgres and sqlite
+func ensureGuildTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS guilds (
+		  id TEXT PRIMARY KEY,
+		  name TEXT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS guild_members (
+		  guild_id TEXT NOT NULL REFERENCES guilds(id) ON DELETE CASCADE,
+		  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		  PRIMARY KEY (guild_id, user_id)
+		);
+		CREATE INDEX IF NOT EXISTS guild_members_user_idx ON guild_members(user_id);
+	`)
+	return err
+}
+
+func (s *server) mountGuilds(mux *http.ServeMux) {
+	mux.HandleFunc("GET /guilds", s.handleListGuilds)
+	mux.HandleFunc("PUT /guilds/{id}", s.handlePutGuild)
+}
+
+//GET /guilds
+//member counts only, who is in a guild shows through ?guild= on /activity
+func (s *server) handleListGuilds(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query(`
+		select g.id, g.name, count(gm.user_id)
+		from guilds g
+		left join guild_members gm on gm.guild_id = g.id
+		group by g.id, g.name
+		order by g.name`)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	defer rows.Close()
+	out := []guild{}
+	for rows.Next() {
+		var g guild
+		if err := rows.Scan(&g.ID, &g.Name, &g.Members); err != nil { http.Error(w, err.Error(), 500); return }
+		out = append(out, g)
+	}
+	if err := rows.Err(); err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, out)
+}
+
+//PUT /guilds/{id} {"name":"Platform","members":["<asana gid>",...]}
+//creates the guild or replaces its name and member list
+func (s *server) handlePutGuild(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireScope(w, r, scopeAdmin); !ok { return }
+
+	var body struct {
+		Name    string   `json:"name"`
+		Members []string `json:"members"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, "bad json", 400); return }
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" { http.Error(w, "name is required", 400); return }
+
+	g, err := s.setGuild(r.PathValue("id"), body.Name, body.Members)
+	if errors.Is(err, errUnknownMember) { http.Error(w, err.Error(), 400); return }
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, g)
+}
+
+//creates the guild or replaces its name and member list. members have to be
+//users the board already knows, one unknown id leaves the guild as it was
+func (s *server) setGuild(id, name string, members []string) (guild, error) {
+	members = slices.Clone(members)
+	slices.Sort(members)
+	members = slices.Compact(members)
+	g := guild{ID: id, Name: name, Members: len(members)}
+
+	tx, err := s.db.Begin()
+	if err != nil { return g, err }
+	defer tx.Rollback()
+	_, err = tx.Exec(`insert into guilds(id, name) values($1,$2)
+		on conflict (id) do update set name=excluded.name`, id, name)
+	if err != nil { return g, err }
+	if _, err := tx.Exec(`delete from guild_members where guild_id=$1`, id); err != nil { return g, err }
+	for _, u := range members {
+		res, err := tx.Exec(`insert into guild_members(guild_id, user_id)
+			select $1, id from users where id=$2`, id, u)
+		if err != nil { return g, err }
+		if n, _ := res.RowsAffected(); n == 0 { return g, fmt.Errorf("%w %s", errUnknownMember, u) }
+	}
+	return g, tx.Commit()
+}
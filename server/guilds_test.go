@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGuildActivityFilter(t *testing.T) {
+	s := visibilityFixture(t)
+	s.cfg.AdminUserIDs = []string{"U3"}
+	put := func(userID, id, body string) *httptest.ResponseRecorder {
+		r := signedIn(t, s, httptest.NewRequest("PUT", "/guilds/"+id, strings.NewReader(body)), userID)
+		r.SetPathValue("id", id)
+		rec := httptest.NewRecorder()
+		s.handlePutGuild(rec, r)
+		return rec
+	}
+
+	if rec := put("U2", "g1", `{"name":"Platform","members":["U2"]}`); rec.Code != 403 { t.Errorf("non admin put: %d", rec.Code) }
+	if rec := put("U3", "g1", `{"name":"Platform","members":["U2","U3","U2"]}`); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"members":2`) {
+		t.Fatalf("put: %d %s", rec.Code, rec.Body)
+	}
+	//a bad member leaves the guild as it was
+	if rec := put("U3", "g1", `{"name":"Renamed","members":["U1","nobody"]}`); rec.Code != 400 { t.Errorf("unknown member: %d", rec.Code) }
+
+	rec := httptest.NewRecorder()
+	s.handleListGuilds(rec, httptest.NewRequest("GET", "/guilds", nil))
+	if got := rec.Body.String(); !strings.Contains(got, `{"id":"g1","name":"Platform","members":2}`) { t.Errorf("guilds: %s", got) }
+
+	rec = activityAs(t, s, "U1", "?guild=g1")
+	body := rec.Body.String()
+	if rec.Code != 200 || !strings.Contains(body, `"user_id":"U2"`) || !strings.Contains(body, `"user_id":"U3"`) || strings.Contains(body, `"user_id":"U1"`) {
+		t.Errorf("guild feed: %d %s", rec.Code, body)
+	}
+	//the guild filter doesn't get around profile visibility
+	if body := activityAs(t, s, "", "?guild=g1").Body.String(); strings.Contains(body, `"user_id":"U2"`) { t.Errorf("anonymous guild feed shows a team profile: %s", body) }
+	if rec := activityAs(t, s, "", "?guild=nope"); rec.Code != 404 { t.Errorf("unknown guild: %d", rec.Code) }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//ok, stale and unknown leave the instance ready, down does not
+type componentStatus struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (s *server) mountHealth(mux *http.ServeMux) {
+	//kept for existing probes, same as live
+	mux.HandleFunc("GET /health", s.handleLive)
+	mux.HandleFunc("GET /health/live", s.handleLive)
+	mux.HandleFunc("GET /health/ready", s.handleReady)
+}
+
+//GET /health/live
+//the process is up and serving, nothing else is checked
+func (s *server) handleLive(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+//GET /health/ready
+//503 when the database is unreachable or migrations are missing. a stale or
+//failing asana sync is reported but doesn't pull the instance out of rotation
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	components := map[string]componentStatus{
+		"database":   s.checkDatabase(ctx),
+		"migrations": s.checkMigrations(ctx),
+		"sync":       s.checkSync(ctx),
+	}
+	status, code := "ok", http.StatusOK
+	for _, c := range components {
+		if c.Status == "down" { status, code = "down", http.StatusServiceUnavailable }
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	writeJSON(w, map[string]any{
+		"status":     status,
+		"components": components,
+	})
+}
+
+func (s *server) checkDatabase(ctx context.Context) componentStatus {
+	if err := s.db.PingContext(ctx); err != nil {
+		return componentStatus{Status: "down", Detail: err.Error()}
+	}
+	return componentStatus{Status: "ok"}
+}
+
+func (s *server) checkMigrations(ctx context.Context) componentStatus {
+	rows, err := s.db.QueryContext(ctx, `select name from schema_migrations`)
+	if err != nil { return componentStatus{Status: "down", Detail: err.Error()} }
+	defer rows.Close()
+	applied := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil { return componentStatus{Status: "down", Detail: err.Error()} }
+		applied[name] = true
+	}
+	var pending []string
+	for _, m := range s.cfg.migrations() {
+		if !applied[m.name] { pending = append(pending, m.name) }
+	}
+	if len(pending) > 0 {
+		return componentStatus{Status: "down", Detail: "pending: " + strings.Join(pending, ", ")}
+	}
+	return componentStatus{Status: "ok"}
+}
+
+//stale once the newest success is older than SYNC_STALE_AFTER (default 1h)
+func (s *server) checkSync(ctx context.Context) componentStatus {
+	//no max() here, sqlite hands aggregates back as plain numbers
+	var last *time.Time
+	var lastErr *string
+	err := s.db.QueryRowContext(ctx, `
+		select last_success_at from sync_status
+		where last_success_at is not null
+		order by last_success_at desc limit 1`).Scan(&last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { return componentStatus{Status: "down", Detail: err.Error()} }
+	err = s.db.QueryRowContext(ctx, `
+		select last_error from sync_status
+		where last_error_at is not null and (last_success_at is null or last_error_at > last_success_at)
+		order by last_error_at desc limit 1`).Scan(&lastErr)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { return componentStatus{Status: "down", Detail: err.Error()} }
+
+	staleAfter := s.cfg.SyncStaleAfter
+
+	c := componentStatus{Status: "ok"}
+	switch {
+	case last == nil:
+		c = componentStatus{Status: "unknown", Detail: "no successful sync yet"}
+	case time.Since(*last) > staleAfter:
+		c = componentStatus{Status: "stale", Detail: "last success " + last.UTC().Format(time.RFC3339)}
+	default:
+		c.Detail = "last success " + last.UTC().Format(time.RFC3339)
+	}
+	if lastErr != nil { c.Detail += ", last error: " + *lastErr }
+	return c
+}
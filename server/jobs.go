@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+//background work that should finish before the process exits, like the
+//sync kicked off after login or notification retries
+type jobs struct {
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newJobs() *jobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobs{ctx: ctx, cancel: cancel}
+}
+
+//runs fn in its own goroutine. ctx is cancelled only when shutdown runs out
+//of time, jobs should wrap up or checkpoint when it fires
+func (j *jobs) Go(name string, fn func(ctx context.Context)) {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		start := time.Now()
+		fn(j.ctx)
+		slog.Debug("job done", "job", name, "duration_ms", time.Since(start).Milliseconds())
+	}()
+}
+
+//blocks until every job returned. when ctx expires first the jobs are
+//cancelled and get a few more seconds to react
+func (j *jobs) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() { j.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	j.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(5 * time.Second):
+		return errors.New("background jobs still running at exit")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var errSelfKudos = errors.New("can't give yourself kudos")
+
+//kudos are zero-point activity rows, via says where they came from (api, slack)
+func (s *server) giveKudos(from, to, msg, via string) error {
+	if from == to { return errSelfKudos }
+	return s.recordActivity(activityKudos, to, "", 0, map[string]any{
+		"from":    from,
+		"message": msg,
+		"via":     via,
+	})
+}
+
+func (s *server) mountKudos(mux *http.ServeMux) {
+	mux.HandleFunc("POST /users/{id}/kudos", s.handleKudos)
+}
+
+//POST /users/{id}/kudos {"message":"thanks for the review"}
+func (s *server) handleKudos(w http.ResponseWriter, r *http.Request) {
+	from, ok := s.requireScope(w, r, scopeWriteKudos)
+	if !ok { return }
+
+	var body struct{ Message string `json:"message"` }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, "bad json", 400); return }
+	msg := strings.TrimSpace(body.Message)
+	if msg == "" || len(msg) > 500 { http.Error(w, "message must be 1-500 characters", 400); return }
+
+	to := r.PathValue("id")
+	var exists bool
+	if err := s.db.QueryRow(`select exists(select 1 from users where id=$1)`, to).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	if !exists { http.Error(w, "not found", 404); return }
+
+	if err := s.giveKudos(from, to, msg, "api"); err != nil {
+		if errors.Is(err, errSelfKudos) { http.Error(w, err.Error(), 400); return }
+		http.Error(w, err.Error(), 500); return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
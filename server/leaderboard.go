@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//which slice of time points are counted over and how ties are numbered
+type boardQuery struct {
+	window string     // all, week, month, season
+	dense  bool       // 1,2,2,3 instead of 1,2,2,4
+	since  *time.Time // start of the window, nil for all
+	viewer string     // only users whose profile they can see are listed, "" for anonymous
+}
+
+func (s *server) parseBoardQuery(r *http.Request) (boardQuery, error) {
+	q := r.URL.Query()
+	bq := boardQuery{window: q.Get("window"), viewer: s.profileViewer(r)}
+	switch bq.window {
+	case "", "all", "all-time":
+		bq.window = "all"
+	case "week", "month":
+		since := windowStart(bq.window, time.Now())
+		bq.since = &since
+	case "season":
+		se, err := s.currentSeason()
+		if err != nil { return bq, err }
+		bq.since = &se.StartedAt
+	default:
+		return bq, errors.New("window must be week, month, season or all")
+	}
+	switch q.Get("rank") {
+	case "", "competition":
+	case "dense":
+		bq.dense = true
+	default:
+		return bq, errors.New("rank must be competition or dense")
+	}
+	return bq, nil
+}
+
+//monday 00:00 or the 1st of the month, in utc
+func windowStart(window string, now time.Time) time.Time {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if window == "month" { return day.AddDate(0, 0, 1-day.Day()) }
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+//a "ranked" CTE with user_id, name, points, rank and pos (1-based position, ties broken by name)
+//holding the users bq.viewer can see. all-time reads scores, other windows sum the activity
+//ledger since bq.since. the window start and viewer are passed from $n on, after the
+//caller's own arguments, see args
+func (bq boardQuery) rankedSQL(n int) string {
+	since, wc := bq.filters(n)
+	points := `(select points from scores sc where sc.user_id = u.id)`
+	if bq.since != nil {
+		points = `(select sum(a.points) from activity a
+		  where a.user_id = u.id and a.created_at >= ` + since + `)`
+	}
+	rank := "rank()"
+	if bq.dense { rank = "dense_rank()" }
+	//hidden users still take up their rank, like in the exports, they're left out after
+	return `
+		with pts as (
+		  select u.id, u.name, u.profile_visibility, coalesce(` + points + `, 0) as points
+		  from users u
+		),
+		everyone as (
+		  select id, name, profile_visibility, points,
+		    ` + rank + ` over (order by points desc) as rank
+		  from pts
+		),
+		ranked as (
+		  select u.id as user_id, u.name, u.points, u.rank,
+		    row_number() over (order by u.points desc, u.name asc) as pos
+		  from everyone u
+		  ` + wc.sql() + `
+		)`
+}
+
+//the window start placeholder and the visibility filter, numbered after n-1 caller arguments
+func (bq boardQuery) filters(n int) (string, whereClause) {
+	wc := whereClause{args: make([]any, n-1)}
+	var since string
+	if bq.since != nil { since = wc.arg(*bq.since) }
+	wc.visibleTo(bq.viewer)
+	return since, wc
+}
+
+//the caller's arguments followed by the window start and viewer
+func (bq boardQuery) args(args ...any) []any {
+	_, wc := bq.filters(len(args) + 1)
+	return append(args, wc.args[len(args):]...)
+}
+
+func scanBoard(rows *sql.Rows) ([]leaderboardRow, error) {
+	defer rows.Close()
+	out := []leaderboardRow{}
+	for rows.Next() {
+		var row leaderboardRow
+		if err := rows.Scan(&row.UserID, &row.Name, &row.Points, &row.Rank); err != nil {
+			return nil, err
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+func (s *server) leaderboardPage(bq boardQuery, limit, offset int) ([]leaderboardRow, error) {
+	rows, err := s.db.Query(bq.rankedSQL(3)+`
+		select user_id, name, points, rank from ranked
+		where pos > $1
+		order by pos
+		limit $2`, bq.args(offset, limit)...)
+	if err != nil { return nil, err }
+	return scanBoard(rows)
+}
+
+func (s *server) mountLeaderboard(mux *http.ServeMux) {
+	mux.HandleFunc("GET /leaderboard", s.handleLeaderboard)
+	mux.HandleFunc("GET /leaderboard/me", s.handleLeaderboardMe)
+}
+
+//GET /leaderboard?window=week|month|season|all&rank=competition|dense&limit=&offset=
+//the next page starts at X-Next-Offset, the header is missing on the last page
+func (s *server) handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	bq, err := s.parseBoardQuery(r)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+	limit, offset := 10, 0
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 100 { limit = v }
+	if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v > 0 { offset = v }
+
+	out, err := s.leaderboardPage(bq, limit+1, offset)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if len(out) > limit {
+		out = out[:limit]
+		w.Header().Set("X-Next-Offset", strconv.Itoa(offset+limit))
+	}
+	writeJSON(w, out)
+}
+
+//GET /leaderboard/me?n=&window=&rank=
+//the caller's row plus up to n players on each side
+func (s *server) handleLeaderboardMe(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.requireScope(w, r, scopeReadLeaderboard)
+	if !ok { return }
+	bq, err := s.parseBoardQuery(r)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+	bq.viewer = userID
+	n := 3
+	if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v >= 0 && v <= 25 { n = v }
+
+	rows, err := s.db.Query(bq.rankedSQL(3)+`,
+		me as (select pos from ranked where user_id = $1)
+		select r.user_id, r.name, r.points, r.rank
+		from ranked r, me
+		where r.pos between me.pos - $2 and me.pos + $2
+		order by r.pos`, bq.args(userID, n)...)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	around, err := scanBoard(rows)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	var me *leaderboardRow
+	for i := range around {
+		if around[i].UserID == userID { me = &around[i] }
+	}
+	if me == nil { http.Error(w, "not on the leaderboard", 404); return }
+	writeJSON(w, map[string]any{
+		"me":     me,
+		"around": around,
+	})
+}
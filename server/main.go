@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -13,7 +19,17 @@ import (
 )
 
 type server struct {
-	db *sql.DB
+	db       *sql.DB
+	cfg      config
+	hub      *hub
+	jobs     *jobs
+	notifier *notifier
+	//webhook deliveries ask the sync loop for a run through this
+	syncKick chan struct{}
+
+	users    UserStore
+	sessions SessionStore
+	quests   QuestStore
 }
 
 type quest struct {
@@ -22,12 +38,15 @@ type quest struct {
 	Difficulty  string  `json:"difficulty"`
 	Completed   bool    `json:"completed"`
 	CompletedBy *string `json:"completed_by,omitempty"`
+	AssigneeID  *string `json:"assignee_id,omitempty"`
+	State       string  `json:"state,omitempty"`
 }
 
 type leaderboardRow struct {
 	UserID string  `json:"user_id"`
 	Name   string  `json:"name"`
 	Points float64 `json:"points"`
+	Rank   int     `json:"rank"`
 }
 
 
@@ -35,103 +54,190 @@ func main() {
 	_ = godotenv.Load(".env.api")
 	// _ = godotenv.Load("../.env.api")
 	// _ = godotenv.Load("../../.env.api")
+	cfg, err := loadConfig()
+	if err != nil { log.Fatal(err) }
+	setupLogger(cfg)
 
-	dsn := getenv("DATABASE_URL", "")
-	port := getenv("API_PORT", "8080")
-	origin := getenv("CORS_ORIGIN", "http://localhost:5173")
-	if dsn == "" {
-		log.Fatal("missing DATABASE_URL")
+	//no subcommand means serve, so plain `go run .` still starts the api
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	if err := runCommand(cfg, cmd, args); err != nil {
+		//plain stderr, the default logger may be json by now
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+}
 
+func openDB(dsn string) (*sql.DB, error) {
+	if path, ok := sqlitePath(dsn); ok { return openSQLite(path) }
 	db, err := sql.Open("postgres", dsn)
-	if err != nil { log.Fatal(err) }
-	if err := db.Ping(); err != nil { log.Fatal(err) }
-	if err := ensureAuthTables(db); err != nil { log.Fatal(err) }
+	if err != nil { return nil, err }
+	if err := db.Ping(); err != nil { return nil, err }
+	return db, nil
+}
+
+//every schema step in order. they are all idempotent and rerun on each
+//migrate, the names land in schema_migrations so readiness can spot a
+//binary that is newer than its database
+type migration struct {
+	name string
+	up   func(*sql.DB) error
+	//the step on sqlite, nil when the sqlite tables of earlier steps already
+	//have what it adds
+	sqlite func(*sql.DB) error
+}
+
+var migrations = []migration{
+	{"auth", ensureAuthTables, ensureAuthTablesSQLite},
+	{"scoring", ensureScoringTables, ensureScoringTablesSQLite},
+	{"activity", ensureActivityTables, ensureActivityTablesSQLite},
+	{"notify", ensureNotifyTables, ensureNotifyTablesSQLite},
+	{"slack", ensureSlackTables, ensureSlackTablesSQLite},
+	{"recompute", ensureRecomputeTables, ensureRecomputeTablesSQLite},
+	{"profile", ensureProfileTables, nil},
+	{"tokens", ensureTokenTables, ensureTokenTablesSQLite},
+	{"claims", ensureClaimTables, ensureClaimTablesSQLite},
+	{"bounties", ensureBountyTables, ensureBountyTablesSQLite},
+	{"due_dates", ensureDueDateTables, nil},
+	{"sections", ensureSectionTables, ensureSectionTablesSQLite},
+	{"seasons", ensureSeasonTables, ensureSeasonTablesSQLite},
+	{"badges", ensureBadgeTables, ensureBadgeTablesSQLite},
+	{"guilds", ensureGuildTables, ensureGuildTables},
+	{"webhooks", ensureWebhookTables, ensureWebhookTablesSQLite},
+}
+
+//the steps for the database cfg points at, same names either way
+func (c config) migrations() []migration {
+	if !c.sqlite() { return migrations }
+	out := make([]migration, 0, len(migrations))
+	for _, m := range migrations {
+		up := m.sqlite
+		if up == nil { up = func(*sql.DB) error { return nil } }
+		out = append(out, migration{name: m.name, up: up})
+	}
+	return out
+}
+
+//creates every table the api needs, safe to run repeatedly
+func migrate(db *sql.DB, steps []migration) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil { return err }
+	for _, m := range steps {
+		if err := m.up(db); err != nil { return fmt.Errorf("migration %s: %w", m.name, err) }
+		_, err := db.Exec(`insert into schema_migrations(name) values($1) on conflict (name) do nothing`, m.name)
+		if err != nil { return err }
+	}
+	return nil
+}
+
+//st is newSQLStore(db) outside of tests
+func newServer(db *sql.DB, cfg config, st store) *server {
+	j := newJobs()
+	return &server{
+		db: db, cfg: cfg, hub: newHub(), jobs: j, notifier: loadNotifier(db, cfg, j), syncKick: make(chan struct{}, 1),
+		users: st, sessions: st, quests: st,
+	}
+}
+
+//every route with cors, csrf, metrics and request logs around it
+func (s *server) handler() http.Handler {
+	policy := newCORSPolicy(s.cfg.CORSOrigins, int(s.cfg.CORSMaxAge.Seconds()))
 
-	s := &server{db: db}
+	//probes and scrapers stay at the root, the frontend calls /api/...
+	root := http.NewServeMux()
+	s.mountHealth(root)
+	s.mountMetrics(root)
+	s.mountWeb(root)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("ok"))
-	})
-	mux.HandleFunc("GET /leaderboard", s.handleLeaderboard)
+	root.Handle("/api/", apiPrefix(mux))
 	mux.HandleFunc("GET /quests", s.handleQuests)
 
-	s.mountAuth(mux, origin)
+	s.mountAuth(mux)
 	s.mountMe(mux)
 	s.mountLogout(mux)
+	s.mountLeaderboard(mux)
 	s.mountAsana(mux)
+	s.mountActivity(mux)
+	s.mountEvents(mux)
+	s.mountSlack(mux)
+	s.mountExport(mux)
+	s.mountProfile(mux)
+	s.mountTokens(mux)
+	s.mountKudos(mux)
+	s.mountAdmin(mux)
+	s.mountClaims(mux)
+	s.mountComplete(mux)
+	s.mountBounties(mux)
+	s.mountSections(mux)
+	s.mountSeasons(mux)
+	s.mountGuilds(mux)
 
-	handler := cors(origin, mux)
-
-	log.Println("api listening on :" + port)
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+	return logRequests(instrument(policy.handler(csrfProtect(policy, s.sessionCookieName(), root))))
 }
 
-func getenv(k, def string) string {
-	if v := os.Getenv(k); v != "" { return v }
-	return def
-}
+func (s *server) serve() error {
+	//a sqlite file has one api process, publish hands events to the hub directly
+	if !s.cfg.sqlite() { go s.listenEvents(s.cfg.DatabaseURL) }
 
-func cors(origin string, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent); return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
+	srv := &http.Server{
+		Addr:              ":" + s.cfg.Port,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+	}
+	//sse streams never go idle, end them so Shutdown can finish
+	srv.RegisterOnShutdown(s.hub.close)
 
-func (s *server) handleLeaderboard(w http.ResponseWriter, r *http.Request) {
-	rows, err := s.db.Query(`
-		select u.id, u.name, coalesce(sc.points,0)
-		from users u
-		left join scores sc on sc.user_id = u.id
-		order by coalesce(sc.points,0) desc, u.name asc
-		limit 10`)
-	if err != nil { http.Error(w, err.Error(), 500); return }
-	defer rows.Close()
-
-	var out []leaderboardRow
-	for rows.Next() {
-		var row leaderboardRow
-		if err := rows.Scan(&row.UserID, &row.Name, &row.Points); err != nil {
-			http.Error(w, err.Error(), 500); return
-		}
-		out = append(out, row)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	//jobs, so shutdown waits for a run in flight instead of cutting it off
+	//and nothing they queue races jobs.Wait
+	s.jobs.Go("sync loop", func(jctx context.Context) { s.syncLoop(ctx, jctx) })
+	s.jobs.Go("claim expiry loop", func(jctx context.Context) { s.claimExpiryLoop(ctx, jctx) })
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	slog.Info("api listening", "port", s.cfg.Port)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(out)
-}
 
+	//in-flight requests and background jobs share one drain budget
+	timeout := s.cfg.ShutdownTimeout
+	slog.Info("shutting down", "timeout", timeout.String())
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		slog.Warn("http drain incomplete", "err", err)
+	}
+	if err := s.jobs.Wait(sctx); err != nil {
+		slog.Warn("jobs drain incomplete", "err", err)
+	}
+	slog.Info("stopped")
+	return nil
+}
 
 func (s *server) handleQuests(w http.ResponseWriter, r *http.Request) {
-	rows, err := s.db.Query(`
-		select id, name, difficulty, completed, completed_by
-		from quests
-		order by completed asc, name asc
-		limit 200`)
+	out, err := s.quests.ListQuests(r.Context(), 200)
 	if err != nil { http.Error(w, err.Error(), 500); return }
-	defer rows.Close()
-
-	var out []quest
-	for rows.Next() {
-		var q quest
-		if err := rows.Scan(&q.ID, &q.Name, &q.Difficulty, &q.Completed, &q.CompletedBy); err != nil {
-			http.Error(w, err.Error(), 500); return
-		}
-		out = append(out, q)
-	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
 }
 
 
-// call once after opening DB
+//the auth step of migrate
 func ensureAuthTables(db *sql.DB) error {
 	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS users (
@@ -171,3 +277,45 @@ func ensureAuthTables(db *sql.DB) error {
 	return err
 }
 
+//sqlite has no timestamptz or now(). TIMESTAMP columns hold unix millis,
+//which the driver turns back into time.Time
+func ensureAuthTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+		  id TEXT PRIMARY KEY,
+		  name TEXT NOT NULL,
+		  avatar_url TEXT,
+		  --from the profile step on postgres
+		  profile_visibility TEXT NOT NULL DEFAULT 'public'
+		);
+
+		CREATE TABLE IF NOT EXISTS oauth_accounts (
+		  user_id TEXT NOT NULL REFERENCES users(id),
+		  provider TEXT NOT NULL,
+		  access_token TEXT NOT NULL,
+		  refresh_token TEXT,
+		  scope TEXT,
+		  expires_at TIMESTAMP,
+		  PRIMARY KEY (user_id, provider)
+		);
+
+		CREATE TABLE IF NOT EXISTS sessions (
+		  id TEXT PRIMARY KEY,
+		  user_id TEXT NOT NULL REFERENCES users(id),
+		  created_at TIMESTAMP DEFAULT `+sqliteNow+`
+		);
+
+		CREATE TABLE IF NOT EXISTS sessions_meta (
+		  id TEXT PRIMARY KEY,
+		  state TEXT,
+		  code_verifier TEXT,
+		  created_at TIMESTAMP DEFAULT `+sqliteNow+`
+		);
+
+		CREATE TABLE IF NOT EXISTS scores (
+		  user_id TEXT PRIMARY KEY REFERENCES users(id),
+		  points REAL NOT NULL DEFAULT 0
+		);
+	`)
+	return err
+}
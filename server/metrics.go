@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "questboard_http_requests_total",
+		Help: "HTTP requests by route pattern and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "questboard_http_request_duration_seconds",
+		Help:    "HTTP request latency by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	asanaRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "questboard_asana_requests_total",
+		Help: "Outbound Asana calls by endpoint and status, status is \"error\" when no response came back.",
+	}, []string{"endpoint", "status"})
+
+	asanaDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "questboard_asana_request_duration_seconds",
+		Help:    "Outbound Asana call latency by endpoint.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	asanaRateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "questboard_asana_rate_limited_total",
+		Help: "Asana responses with status 429.",
+	})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "questboard_asana_token_refreshes_total",
+		Help: "OAuth token refreshes by result (ok, error).",
+	}, []string{"result"})
+
+	syncLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "questboard_sync_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful project sync, lag is time() minus this.",
+	}, []string{"project"})
+
+	pointsAwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "questboard_points_awarded_total",
+		Help: "Points written to the activity ledger by kind.",
+	}, []string{"kind"})
+)
+
+//client for every call to app.asana.com so they all get counted
+var asanaHTTP = &http.Client{Transport: asanaMetricsTransport{next: http.DefaultTransport}}
+
+type asanaMetricsTransport struct {
+	next http.RoundTripper
+}
+
+//gids in paths would explode the label set
+var asanaGID = regexp.MustCompile(`/\d+`)
+
+func (t asanaMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.Method + " " + asanaGID.ReplaceAllString(req.URL.Path, "/{gid}")
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	asanaDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		asanaRequests.WithLabelValues(endpoint, "error").Inc()
+		return nil, err
+	}
+	asanaRequests.WithLabelValues(endpoint, strconv.Itoa(res.StatusCode)).Inc()
+	if res.StatusCode == http.StatusTooManyRequests { asanaRateLimited.Inc() }
+	return res, nil
+}
+
+//counts and times every request by its mux pattern, unmatched routes share one label
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 { rec.status = http.StatusOK }
+
+		route := r.Pattern
+		if route == "" { route = "unmatched" }
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+func (s *server) mountMetrics(mux *http.ServeMux) {
+	mux.Handle("GET /metrics", promhttp.Handler())
+}
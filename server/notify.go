@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+//a place announcements can be delivered to
+type notifySink interface {
+	name() string
+	send(ctx context.Context, ev notifyEvent) error
+}
+
+//event as seen by sinks, data is round-tripped through json so rules see
+//the same shapes no matter who published it
+type notifyEvent struct {
+	Kind string         `json:"kind"`
+	Data map[string]any `json:"data"`
+}
+
+//decides which published events get announced and to which sinks
+type notifyRule struct {
+	name  string
+	match func(ev notifyEvent) bool
+	sinks []string
+}
+
+type notifier struct {
+	db      *sql.DB
+	jobs    *jobs
+	sinks   map[string]notifySink
+	rules   []notifyRule
+	retries int
+	backoff time.Duration
+}
+
+func ensureNotifyTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS notify_dead_letters (
+		  id BIGSERIAL PRIMARY KEY,
+		  sink TEXT NOT NULL,
+		  kind TEXT NOT NULL,
+		  payload JSONB NOT NULL,
+		  error TEXT NOT NULL,
+		  attempts INT NOT NULL,
+		  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+	`)
+	return err
+}
+
+func ensureNotifyTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS notify_dead_letters (
+		  id INTEGER PRIMARY KEY,
+		  sink TEXT NOT NULL,
+		  kind TEXT NOT NULL,
+		  payload TEXT NOT NULL,
+		  error TEXT NOT NULL,
+		  attempts INT NOT NULL,
+		  created_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`
+		);
+	`)
+	return err
+}
+
+//sinks are enabled by setting their env vars, routes look like
+//NOTIFY_ROUTES="hard_quest=slack,email;top_spot=slack" and default to every enabled sink
+func loadNotifier(db *sql.DB, cfg config, j *jobs) *notifier {
+	n := &notifier{db: db, jobs: j, sinks: map[string]notifySink{}, retries: 3, backoff: 2 * time.Second}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	if u := cfg.NotifyWebhookURL; u != "" {
+		n.sinks["webhook"] = &webhookSink{url: u, client: client}
+	}
+	if u := cfg.SlackWebhookURL; u != "" {
+		n.sinks["slack"] = &slackSink{url: u, client: client}
+	}
+	if addr := cfg.SMTPAddr; addr != "" {
+		n.sinks["email"] = &smtpSink{
+			addr: addr,
+			user: cfg.SMTPUser,
+			pass: cfg.SMTPPass,
+			from: cfg.SMTPFrom,
+			to:   cfg.NotifyEmailTo,
+		}
+	}
+
+	var all []string
+	for name := range n.sinks { all = append(all, name) }
+	routes := parseNotifyRoutes(cfg.NotifyRoutes)
+	for _, r := range defaultNotifyRules() {
+		r.sinks = all
+		if sinks, ok := routes[r.name]; ok { r.sinks = sinks }
+		n.rules = append(n.rules, r)
+	}
+	return n
+}
+
+func parseNotifyRoutes(v string) map[string][]string {
+	out := map[string][]string{}
+	for _, part := range strings.Split(v, ";") {
+		rule, sinks, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok { continue }
+		var list []string
+		for _, s := range strings.Split(sinks, ",") {
+			if s = strings.TrimSpace(s); s != "" { list = append(list, s) }
+		}
+		out[strings.TrimSpace(rule)] = list
+	}
+	return out
+}
+
+func defaultNotifyRules() []notifyRule {
+	return []notifyRule{
+		{name: "hard_quest", match: func(ev notifyEvent) bool {
+			detail, _ := ev.Data["detail"].(map[string]any)
+			return ev.Kind == activityQuestCompleted && detail["difficulty"] == "hard"
+		}},
+		{name: "top_spot", match: func(ev notifyEvent) bool {
+			detail, _ := ev.Data["detail"].(map[string]any)
+			to, _ := detail["to"].(float64)
+			return ev.Kind == activityRankUp && to == 1
+		}},
+	}
+}
+
+//fans the event out to every sink its rules route it to, never blocks the caller
+func (n *notifier) dispatch(kind string, data any) {
+	if n == nil || len(n.sinks) == 0 { return }
+	b, err := json.Marshal(data)
+	if err != nil { return }
+	ev := notifyEvent{Kind: kind}
+	if err := json.Unmarshal(b, &ev.Data); err != nil { return }
+
+	sent := map[string]bool{}
+	for _, r := range n.rules {
+		if !r.match(ev) { continue }
+		for _, name := range r.sinks {
+			sink, ok := n.sinks[name]
+			if !ok || sent[name] { continue }
+			sent[name] = true
+			n.jobs.Go("notify "+name, func(ctx context.Context) { n.deliver(ctx, sink, ev) })
+		}
+	}
+}
+
+//retries with doubling backoff, then parks the event in notify_dead_letters.
+//a cancelled ctx (shutdown out of time) skips straight to the dead letter
+func (n *notifier) deliver(ctx context.Context, sink notifySink, ev notifyEvent) {
+	var err error
+	attempts := 0
+	wait := n.backoff
+	for attempts < n.retries && ctx.Err() == nil {
+		if attempts > 0 {
+			select {
+			case <-time.After(wait):
+				wait *= 2
+			case <-ctx.Done():
+				continue
+			}
+		}
+		attempts++
+		sctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		err = sink.send(sctx, ev)
+		cancel()
+		if err == nil { return }
+	}
+	if err == nil { err = ctx.Err() }
+	slog.Error("notify gave up", "sink", sink.name(), "kind", ev.Kind, "attempts", attempts, "err", err)
+	payload, _ := json.Marshal(ev)
+	_, dbErr := n.db.Exec(`insert into notify_dead_letters(sink, kind, payload, error, attempts)
+		values($1,$2,$3,$4,$5)`, sink.name(), ev.Kind, string(payload), err.Error(), attempts)
+	if dbErr != nil { slog.Error("notify dead letter", "err", dbErr) }
+}
+
+//one line summary used by slack and email
+func notifyText(ev notifyEvent) string {
+	who, _ := ev.Data["user_name"].(string)
+	if who == "" { who, _ = ev.Data["user_id"].(string) }
+	switch ev.Kind {
+	case activityQuestCompleted:
+		quest, _ := ev.Data["quest_name"].(string)
+		points, _ := ev.Data["points"].(float64)
+		return fmt.Sprintf("%s completed the hard quest \"%s\" (+%g pts)", who, quest, points)
+	case activityRankUp:
+		return fmt.Sprintf("%s took the #1 spot on the leaderboard", who)
+	}
+	return fmt.Sprintf("%s: %s", ev.Kind, who)
+}
+
+//POSTs the raw event json
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookSink) name() string { return "webhook" }
+
+func (w *webhookSink) send(ctx context.Context, ev notifyEvent) error {
+	b, _ := json.Marshal(ev)
+	return postJSON(ctx, w.client, w.url, b)
+}
+
+//slack incoming webhook, see https://api.slack.com/messaging/webhooks
+type slackSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *slackSink) name() string { return "slack" }
+
+func (s *slackSink) send(ctx context.Context, ev notifyEvent) error {
+	b, _ := json.Marshal(map[string]string{"text": ":crossed_swords: " + slackEscape(notifyText(ev))})
+	return postJSON(ctx, s.client, s.url, b)
+}
+
+func postJSON(ctx context.Context, client *http.Client, u string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil { return err }
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return errors.New(res.Status + ": " + string(b))
+	}
+	return nil
+}
+
+//plain text mail through any smtp relay, auth is skipped when SMTP_USER is empty
+type smtpSink struct {
+	addr, user, pass, from string
+	to                     []string
+}
+
+func (m *smtpSink) name() string { return "email" }
+
+//quest and user names come from asana, a line break in one would start a new
+//header. non-ascii names go out as rfc 2047 encoded words
+func mailSubject(s string) string {
+	s = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(s)
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+func (m *smtpSink) send(ctx context.Context, ev notifyEvent) error {
+	text := notifyText(ev)
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + strings.Join(m.to, ", ") + "\r\n" +
+		"Subject: " + mailSubject("[quest board] "+text) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + text + "\r\n"
+
+	var auth smtp.Auth
+	if m.user != "" {
+		host, _, _ := strings.Cut(m.addr, ":")
+		auth = smtp.PlainAuth("", m.user, m.pass, host)
+	}
+	//net/smtp has no context support, so honour cancellation around the call
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(m.addr, auth, m.from, m.to, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var hardQuestEvent = notifyEvent{Kind: activityQuestCompleted, Data: map[string]any{
+	"user_name":  "Ada",
+	"quest_name": "fix the build",
+	"points":     3.0,
+	"detail":     map[string]any{"difficulty": "hard"},
+}}
+
+//answers every POST with status and keeps the last body
+func fakeHook(t *testing.T, status int) (*httptest.Server, *[]byte) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "want a json post", 400); return
+		}
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, "nope")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &body
+}
+
+func TestHTTPSinks(t *testing.T) {
+	cases := []struct {
+		name   string
+		sink   func(url string) notifySink
+		status int
+		body   string
+		ok     bool
+	}{
+		{"webhook", func(u string) notifySink { return &webhookSink{url: u, client: http.DefaultClient} }, 200, `"kind":"quest_completed"`, true},
+		{"webhook accepted", func(u string) notifySink { return &webhookSink{url: u, client: http.DefaultClient} }, 202, `"quest_name":"fix the build"`, true},
+		{"webhook down", func(u string) notifySink { return &webhookSink{url: u, client: http.DefaultClient} }, 500, "", false},
+		{"slack", func(u string) notifySink { return &slackSink{url: u, client: http.DefaultClient} }, 200, `Ada completed the hard quest \"fix the build\" (+3 pts)`, true},
+		{"slack gone", func(u string) notifySink { return &slackSink{url: u, client: http.DefaultClient} }, 404, "", false},
+	}
+	for _, c := range cases {
+		srv, body := fakeHook(t, c.status)
+		err := c.sink(srv.URL).send(context.Background(), hardQuestEvent)
+		if (err == nil) != c.ok { t.Errorf("%s: err = %v", c.name, err); continue }
+		if !c.ok {
+			if !strings.Contains(err.Error(), "nope") { t.Errorf("%s: error doesn't carry the body: %v", c.name, err) }
+			continue
+		}
+		if !json.Valid(*body) || !strings.Contains(string(*body), c.body) { t.Errorf("%s: posted %s", c.name, *body) }
+	}
+}
+
+//a minimal smtp server for one or more messages. rcptCode is what it answers RCPT TO with
+type fakeSMTP struct {
+	addr     string
+	rcptCode string
+	mu       sync.Mutex
+	rcpts    []string
+	data     string
+}
+
+func newFakeSMTP(t *testing.T, rcptCode string) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeSMTP{addr: ln.Addr().String(), rcptCode: rcptCode}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil { return }
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	say := func(s string) { io.WriteString(conn, s+"\r\n") }
+	say("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil { return }
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			say("250-fake")
+			say("250 8BITMIME")
+		case strings.HasPrefix(cmd, "MAIL FROM"):
+			say("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO"):
+			f.mu.Lock()
+			f.rcpts = append(f.rcpts, strings.TrimSpace(line[len("RCPT TO:"):]))
+			f.mu.Unlock()
+			say(f.rcptCode + " rcpt")
+		case cmd == "DATA":
+			say("354 go ahead")
+			var b strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil { return }
+				if l == ".\r\n" { break }
+				b.WriteString(l)
+			}
+			f.mu.Lock()
+			f.data = b.String()
+			f.mu.Unlock()
+			say("250 queued")
+		case cmd == "QUIT":
+			say("221 bye")
+			return
+		default:
+			say("250 ok")
+		}
+	}
+}
+
+func TestSMTPSink(t *testing.T) {
+	cases := []struct {
+		name, rcptCode string
+		ok             bool
+	}{
+		{"delivered", "250", true},
+		{"recipient refused", "550", false},
+	}
+	for _, c := range cases {
+		srv := newFakeSMTP(t, c.rcptCode)
+		sink := &smtpSink{addr: srv.addr, from: "board@example.com", to: []string{"a@example.com", "b@example.com"}}
+		err := sink.send(context.Background(), hardQuestEvent)
+		if (err == nil) != c.ok { t.Errorf("%s: err = %v", c.name, err); continue }
+		if !c.ok { continue }
+		srv.mu.Lock()
+		rcpts, data := srv.rcpts, srv.data
+		srv.mu.Unlock()
+		if strings.Join(rcpts, " ") != "<a@example.com> <b@example.com>" { t.Errorf("%s: rcpts = %v", c.name, rcpts) }
+		for _, want := range []string{
+			"From: board@example.com\r\n",
+			"To: a@example.com, b@example.com\r\n",
+			"Subject: [quest board] Ada completed the hard quest \"fix the build\" (+3 pts)\r\n",
+		} {
+			if !strings.Contains(data, want) { t.Errorf("%s: message lacks %q:\n%s", c.name, want, data) }
+		}
+	}
+
+	//a cancelled send gives up without waiting on the relay
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer ln.Close()
+	sink := &smtpSink{addr: ln.Addr().String(), from: "board@example.com", to: []string{"a@example.com"}}
+	if err := sink.send(ctx, hardQuestEvent); err != context.Canceled { t.Errorf("cancelled send: %v", err) }
+}
+
+func TestMailSubject(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"[quest board] Ada completed", "[quest board] Ada completed"},
+		{"fix\r\nBcc: all@example.com", "fix Bcc: all@example.com"},
+		{"line\nbreak\rhere", "line break here"},
+		{"Zoë finished", "=?utf-8?q?Zo=C3=AB_finished?="},
+	}
+	for _, c := range cases {
+		if got := mailSubject(c.in); got != c.want { t.Errorf("mailSubject(%q) = %q, want %q", c.in, got, c.want) }
+	}
+}
+
+func TestSlackSinkEscapes(t *testing.T) {
+	srv, body := fakeHook(t, 200)
+	ev := notifyEvent{Kind: activityQuestCompleted, Data: map[string]any{"user_name": "Ada", "quest_name": "<!channel> fix"}}
+	if err := (&slackSink{url: srv.URL, client: http.DefaultClient}).send(context.Background(), ev); err != nil { t.Fatal(err) }
+	var got struct{ Text string }
+	if err := json.Unmarshal(*body, &got); err != nil { t.Fatal(err) }
+	if !strings.Contains(got.Text, `"&lt;!channel&gt; fix"`) { t.Errorf("posted %q", got.Text) }
+}
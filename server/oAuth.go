@@ -20,35 +20,50 @@ type oauthConfig struct {
 	scopes	   string
 }
 
-func loadOAuth() oauthConfig {
-	return oauthConfig{
-		clientID:	 getenv("ASANA_CLIENT_ID", ""),
-		clientSecret: getenv("ASANA_CLIENT_SECRET", ""),
-		redirectURI:  getenv("ASANA_REDIRECT_URI", ""),
-		scopes:	   getenv("ASANA_SCOPES", "users:read"),
-	}
-}
-
 func randomString(n int) string {
 	b := make([]byte, n)
 	_, _ = rand.Read(b)
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-func setSessionCookie(w http.ResponseWriter, sid string) {
-	http.SetCookie(w, &http.Cookie{
-		Name:	 "sid",
+//COOKIE_HOST_PREFIX renames it to __Host-sid, which browsers only accept
+//when Secure, Path=/ and no Domain, config validation enforces that
+func (s *server) sessionCookieName() string {
+	if s.cfg.CookieHostPrefix { return "__Host-sid" }
+	return "sid"
+}
+
+//maxAge < 0 deletes the cookie
+func (s *server) sessionCookie(sid string, maxAge int) *http.Cookie {
+	sameSite := http.SameSiteLaxMode
+	switch s.cfg.CookieSameSite {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+	return &http.Cookie{
+		Name:	 s.sessionCookieName(),
 		Value:	sid,
 		Path:	 "/",
+		Domain:   s.cfg.CookieDomain,
+		MaxAge:   maxAge,
 		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		//enable when https
-		// Secure: true,
-	})
+		SameSite: sameSite,
+		Secure:   s.cfg.CookieSecure,
+	}
+}
+
+func (s *server) setSessionCookie(w http.ResponseWriter, sid string) {
+	http.SetCookie(w, s.sessionCookie(sid, 0))
+}
+
+func (s *server) clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, s.sessionCookie("", -1))
 }
 
-func getSessionCookie(r *http.Request) string {
-	c, _ := r.Cookie("sid")
+func (s *server) getSessionCookie(r *http.Request) string {
+	c, _ := r.Cookie(s.sessionCookieName())
 	if c == nil { return "" }
 	return c.Value
 }
@@ -61,30 +76,28 @@ func pkce() (codeVerifier, codeChallenge string) {
 }
 
 
-func (s *server) mountAuth(mux *http.ServeMux, origin string) {
+func (s *server) mountAuth(mux *http.ServeMux) {
 	mux.HandleFunc("GET /auth/asana/start", s.handleAsanaStart)
 	mux.HandleFunc("GET /auth/asana/callback", s.handleAsanaCallback)
 }
 
 func (s *server) handleAsanaStart(w http.ResponseWriter, r *http.Request) {
-	cfg := loadOAuth()
+	cfg := s.cfg.oauth()
 	if cfg.clientID == "" || cfg.redirectURI == "" {
 		http.Error(w, "oauth not configured", 500); return
 	}
 
 	state := randomString(24)
 	codeVerifier, codeChallenge := pkce()
-	sid := getSessionCookie(r)
+	sid := s.getSessionCookie(r)
 	if sid == "" { sid = randomString(24) }
 
-	//store these transient values server-side keyed by session id (we'll keep it in memory for dev)
-	//for simplicity here: stash them in a temp table? use a simple map? we'll use table "sessions_meta"
-	//to avoid global maps. create table if it doesn't exist:
-	_, _ = s.db.Exec(`create table if not exists sessions_meta (id text primary key, state text, code_verifier text, created_at timestamptz default now())`)
-	_, _ = s.db.Exec(`insert into sessions_meta(id, state, code_verifier) values($1,$2,$3)
-		on conflict (id) do update set state=excluded.state, code_verifier=excluded.code_verifier`, sid, state, codeVerifier)
+	//store these transient values server-side keyed by session id until the callback
+	if err := s.sessions.SavePending(r.Context(), sid, state, codeVerifier); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
 
-	setSessionCookie(w, sid)
+	s.setSessionCookie(w, sid)
 
 	v := url.Values{}
 	v.Set("client_id", cfg.clientID)
@@ -102,7 +115,7 @@ func (s *server) handleAsanaStart(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleAsanaCallback(w http.ResponseWriter, r *http.Request) {
-	cfg := loadOAuth()
+	cfg := s.cfg.oauth()
 	q := r.URL.Query()
 	code := q.Get("code")
 	state := q.Get("state")
@@ -110,13 +123,12 @@ func (s *server) handleAsanaCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing code/state", 400); return
 	}
 
-	sid := getSessionCookie(r)
+	sid := s.getSessionCookie(r)
 	if sid == "" {
 		http.Error(w, "no session", 400); return
 	}
 
-	var wantState, codeVerifier string
-	err := s.db.QueryRow(`select state, code_verifier from sessions_meta where id=$1`, sid).Scan(&wantState, &codeVerifier)
+	wantState, codeVerifier, err := s.sessions.Pending(r.Context(), sid)
 	if err != nil || wantState != state {
 		http.Error(w, "state mismatch", 400); return
 	}
@@ -129,10 +141,11 @@ func (s *server) handleAsanaCallback(w http.ResponseWriter, r *http.Request) {
 	form.Set("code", code)
 	form.Set("code_verifier", codeVerifier)
 
-	req, _ := http.NewRequest("POST", "https://app.asana.com/-/oauth_token", strings.NewReader(form.Encode()))
+	req, _ := http.NewRequestWithContext(r.Context(), "POST", "https://app.asana.com/-/oauth_token", strings.NewReader(form.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Request-ID", requestIDFrom(r.Context()))
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := asanaHTTP.Do(req)
 	if err != nil { http.Error(w, err.Error(), 502); return }
 	defer res.Body.Close()
 
@@ -162,50 +175,42 @@ func (s *server) handleAsanaCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := tok.Data
-	if user.Gid == "" {
-		//fall back to /users/me if not present
-		req2, _ := http.NewRequestWithContext(context.Background(), "GET", "https://app.asana.com/api/1.0/users/me", nil)
-		req2.Header.Set("Authorization", "Bearer "+tok.AccessToken)
-		res2, err := http.DefaultClient.Do(req2)
-		if err == nil && res2.StatusCode == 200 {
-			defer res2.Body.Close()
-			var wrap struct{ Data struct {
-				Gid string `json:"gid"`
-				Name string `json:"name"`
-				Email string `json:"email"`
-			} `json:"data"` }
-			_ = json.NewDecoder(res2.Body).Decode(&wrap)
-			user = wrap.Data
-		}
-	}
-
-	//upsert user and oauth account
-	_, _ = s.db.Exec(`insert into users(id, name, avatar_url)
-					  values($1,$2,$3)
-					  on conflict (id) do update set name=excluded.name`,
-		user.Gid, user.Name, "")
-
 	expiresAt := time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
-	_, _ = s.db.Exec(`
-		insert into oauth_accounts(user_id, provider, access_token, refresh_token, scope, expires_at)
-		values($1,'asana',$2,$3,$4,$5)
-		on conflict (user_id, provider) do update set
-		  access_token=excluded.access_token,
-		  refresh_token=excluded.refresh_token,
-		  scope=excluded.scope,
-		  expires_at=excluded.expires_at`,
-		user.Gid, tok.AccessToken, tok.RefreshToken, getenv("ASANA_SCOPES", ""), expiresAt)
-
-	_, _ = s.db.Exec(`insert into sessions(id, user_id) values($1,$2)
-		on conflict (id) do update set user_id=excluded.user_id`, sid, user.Gid)
-
-	_, _ = s.db.Exec(`delete from sessions_meta where id=$1`, sid)
+	creds := &asanaTokens{AccessToken: tok.AccessToken, RefreshToken: tok.RefreshToken, ExpiresAt: expiresAt, Scope: cfg.scopes}
+	avatarURL := ""
+	//the token response has no photo, so always ask /users/me and keep tok.Data as the fallback
+	var wrap struct{ Data struct {
+		Gid string `json:"gid"`
+		Name string `json:"name"`
+		Email string `json:"email"`
+		Photo *struct{ Image128 string `json:"image_128x128"` } `json:"photo"`
+	} `json:"data"` }
+	meQ := url.Values{"opt_fields": {"name,email,photo.image_128x128"}}
+	if s.asanaGET(r.Context(), creds, "/users/me", meQ, &wrap) == nil && wrap.Data.Gid != "" {
+		user.Gid, user.Name, user.Email = wrap.Data.Gid, wrap.Data.Name, wrap.Data.Email
+		if wrap.Data.Photo != nil { avatarURL = wrap.Data.Photo.Image128 }
+	}
+	creds.UserID = user.Gid
 
-	go func(r0 *http.Request, uid string) {
-		_ = s.recomputePointsForUser(r0, uid)
-	}(r.Clone(r.Context()), user.Gid)
+	//upsert user and oauth account, then bind the session
+	ctx := r.Context()
+	if err := s.users.UpsertUser(ctx, userRow{ID: user.Gid, Name: user.Name, AvatarURL: &avatarURL}); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	if err := s.users.SaveAsanaTokens(ctx, creds); err != nil { http.Error(w, err.Error(), 500); return }
+	if err := s.sessions.CreateSession(ctx, sid, user.Gid); err != nil { http.Error(w, err.Error(), 500); return }
+	_ = s.sessions.ClearPending(ctx, sid)
+
+	reqID := requestIDFrom(r.Context())
+	s.jobs.Go("initial sync", func(ctx context.Context) {
+		//outlives this request, so only the request id carries over
+		ctx = withRequestID(ctx, reqID)
+		if err := s.recomputePointsForUser(ctx, creds, creds.UserID); err != nil {
+			logFrom(ctx).Error("initial sync failed", "user_id", creds.UserID, "err", err)
+		}
+	})
 
 
-	http.Redirect(w, r, getenv("POST_LOGIN_REDIRECT", "http://localhost:5173/profile"), http.StatusFound)
+	http.Redirect(w, r, s.cfg.PostLoginRedirect, http.StatusFound)
 }
 
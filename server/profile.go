@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+//who can open a user's profile
+const (
+	visibilityPublic  = "public"  // anyone, signed in or not
+	visibilityTeam    = "team"    // anyone signed in to the board, sessions only come from our asana workspace
+	visibilityPrivate = "private" // only the user
+)
+
+type profile struct {
+	UserID       string           `json:"user_id"`
+	Name         string           `json:"name"`
+	AvatarURL    *string          `json:"avatar_url"`
+	Visibility   string           `json:"visibility"`
+	Points       float64          `json:"points"`
+	Rank         int              `json:"rank"`
+	Streak       int              `json:"streak"`
+	Badges       []activityItem   `json:"badges"`
+	Season       *seasonResult    `json:"season"`
+	PastSeasons  []seasonResult   `json:"past_seasons"`
+	Recent       []quest          `json:"recent_completions"`
+	Difficulties []difficultyStat `json:"difficulty_breakdown"`
+}
+
+type difficultyStat struct {
+	Difficulty string  `json:"difficulty"`
+	Completed  int     `json:"completed"`
+	Points     float64 `json:"points"`
+}
+
+func ensureProfileTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS profile_visibility TEXT NOT NULL DEFAULT 'public';
+	`)
+	return err
+}
+
+func (s *server) mountProfile(mux *http.ServeMux) {
+	mux.HandleFunc("GET /users/{id}", s.handleUserProfile)
+	mux.HandleFunc("POST /me/privacy", s.handleSetPrivacy)
+}
+
+//GET /users/{id}
+//hidden profiles answer 404 so they can't be probed for
+func (s *server) handleUserProfile(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	viewer := s.profileViewer(r)
+
+	var p profile
+	err := s.db.QueryRow(`select id, name, avatar_url, profile_visibility from users where id=$1`, id).
+		Scan(&p.UserID, &p.Name, &p.AvatarURL, &p.Visibility)
+	if errors.Is(err, sql.ErrNoRows) { http.Error(w, "not found", 404); return }
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	if !canSeeProfile(p.Visibility, id, viewer) { http.Error(w, "not found", 404); return }
+
+	if err := s.fillProfile(&p); err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, p)
+}
+
+//who is looking, "" for anonymous requests and principals that can't read the board
+func (s *server) profileViewer(r *http.Request) string {
+	if p, err := s.authenticate(r); err == nil && p.can(scopeReadLeaderboard) { return p.userID }
+	return ""
+}
+
+//viewer is "" for anonymous requests
+func canSeeProfile(visibility, id, viewer string) bool {
+	switch {
+	case viewer == id:
+	case visibility == visibilityTeam && viewer != "":
+	case visibility == visibilityPublic:
+	default:
+		return false
+	}
+	return true
+}
+
+//canSeeProfile in sql, for queries that join the user as u
+func (wc *whereClause) visibleTo(viewer string) {
+	if viewer == "" { wc.add("u.profile_visibility = ?", visibilityPublic); return }
+	wc.add("(u.profile_visibility <> 'private' or u.id = ?)", viewer)
+}
+
+func (s *server) fillProfile(p *profile) error {
+	row, rank, err := s.userStanding(p.UserID)
+	if err != nil { return err }
+	p.Points, p.Rank = row.Points, rank
+
+	rows, err := s.db.Query(`
+		select id, name, difficulty, completed, completed_by
+		from quests
+		where completed and completed_by=$1
+		order by completed_at desc nulls last
+		limit 10`, p.UserID)
+	if err != nil { return err }
+	p.Recent = []quest{}
+	for rows.Next() {
+		var q quest
+		if err := rows.Scan(&q.ID, &q.Name, &q.Difficulty, &q.Completed, &q.CompletedBy); err != nil {
+			rows.Close(); return err
+		}
+		p.Recent = append(p.Recent, q)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`
+		select dw.difficulty, count(q.id), coalesce(sum(dw.weight) filter (where q.id is not null), 0)
+		from difficulty_weights dw
+		left join quests q on q.difficulty = dw.difficulty and q.completed and q.completed_by=$1
+		group by dw.difficulty, dw.weight
+		order by dw.weight`, p.UserID)
+	if err != nil { return err }
+	p.Difficulties = []difficultyStat{}
+	for rows.Next() {
+		var d difficultyStat
+		if err := rows.Scan(&d.Difficulty, &d.Completed, &d.Points); err != nil { rows.Close(); return err }
+		p.Difficulties = append(p.Difficulties, d)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`
+		select id, kind, points, detail, created_at from activity
+		where user_id=$1 and kind=$2
+		order by id desc`, p.UserID, activityBadge)
+	if err != nil { return err }
+	p.Badges = []activityItem{}
+	for rows.Next() {
+		it := activityItem{UserID: p.UserID, UserName: p.Name}
+		var detail []byte
+		if err := rows.Scan(&it.ID, &it.Kind, &it.Points, &detail, &it.CreatedAt); err != nil { rows.Close(); return err }
+		_ = json.Unmarshal(detail, &it.Detail)
+		p.Badges = append(p.Badges, it)
+	}
+	rows.Close()
+
+	p.Season, p.PastSeasons, err = s.seasonStats(p.UserID)
+	if err != nil { return err }
+
+	p.Streak, err = s.streakOf(p.UserID)
+	return err
+}
+
+//consecutive UTC days ending today or yesterday with at least one completion
+func (s *server) streakOf(userID string) (int, error) {
+	//days are cut in go, date casts differ between postgres and sqlite
+	rows, err := s.db.Query(`
+		select completed_at from quests
+		where completed and completed_by=$1 and completed_at is not null
+		order by completed_at desc`, userID)
+	if err != nil { return 0, err }
+	defer rows.Close()
+
+	streak := 0
+	want := time.Now().UTC().Truncate(24 * time.Hour)
+	var prev time.Time
+	for rows.Next() {
+		var at time.Time
+		if err := rows.Scan(&at); err != nil { return 0, err }
+		day := at.UTC().Truncate(24 * time.Hour)
+		if day.Equal(prev) { continue }
+		prev = day
+		//a streak that hasn't been extended today yet still counts
+		if streak == 0 && day.Equal(want.AddDate(0, 0, -1)) { want = day }
+		if !day.Equal(want) { break }
+		streak++
+		want = want.AddDate(0, 0, -1)
+	}
+	return streak, rows.Err()
+}
+
+//POST /me/privacy {"visibility":"public|team|private"}
+func (s *server) handleSetPrivacy(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionUserID(r)
+	if err != nil { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+
+	var body struct{ Visibility string `json:"visibility"` }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, "bad json", 400); return }
+	switch body.Visibility {
+	case visibilityPublic, visibilityTeam, visibilityPrivate:
+	default:
+		http.Error(w, "visibility must be public, team or private", 400); return
+	}
+	if _, err := s.db.Exec(`update users set profile_visibility=$1 where id=$2`, body.Visibility, userID); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
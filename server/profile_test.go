@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//U1 is private, U2 team and U3 public, each with some points
+func visibilityFixture(t *testing.T) *server {
+	t.Helper()
+	s := newSQLiteTestServer(t)
+	for id, visibility := range map[string]string{"U1": visibilityPrivate, "U2": visibilityTeam, "U3": visibilityPublic} {
+		_, err := s.db.Exec(`insert into users(id, name, profile_visibility) values($1,$1,$2)`, id, visibility)
+		if err != nil { t.Fatal(err) }
+		if err := s.grantPoints(id, 1, "setup"); err != nil { t.Fatal(err) }
+	}
+	return s
+}
+
+//gives r a session for userID, anonymous when userID is ""
+func signedIn(t *testing.T, s *server, r *http.Request, userID string) *http.Request {
+	t.Helper()
+	if userID == "" { return r }
+	if err := s.sessions.CreateSession(context.Background(), "sid-"+userID, userID); err != nil { t.Fatal(err) }
+	r.AddCookie(&http.Cookie{Name: s.sessionCookieName(), Value: "sid-" + userID})
+	return r
+}
+
+func activityAs(t *testing.T, s *server, viewer, query string) *httptest.ResponseRecorder {
+	r := signedIn(t, s, httptest.NewRequest("GET", "/activity"+query, nil), viewer)
+	rec := httptest.NewRecorder()
+	s.handleActivity(rec, r)
+	return rec
+}
+
+func TestActivityVisibility(t *testing.T) {
+	s := visibilityFixture(t)
+	cases := []struct {
+		viewer, query string
+		code          int
+		see, hidden   []string
+	}{
+		{"", "", 200, []string{"U3"}, []string{"U1", "U2"}},
+		{"", "?user=U3", 200, []string{"U3"}, nil},
+		{"", "?user=U2", 404, nil, nil},
+		{"", "?user=U1", 404, nil, nil},
+		{"", "?user=nobody", 404, nil, nil},
+		{"U2", "", 200, []string{"U2", "U3"}, []string{"U1"}},
+		{"U2", "?user=U1", 404, nil, nil},
+		{"U1", "?user=U1", 200, []string{"U1"}, nil},
+		{"U1", "", 200, []string{"U1", "U2", "U3"}, nil},
+	}
+	for _, c := range cases {
+		rec := activityAs(t, s, c.viewer, c.query)
+		if rec.Code != c.code { t.Errorf("%q %s: code %d, want %d", c.viewer, c.query, rec.Code, c.code); continue }
+		body := rec.Body.String()
+		for _, u := range c.see {
+			if !strings.Contains(body, `"user_id":"`+u+`"`) { t.Errorf("%q %s: missing %s", c.viewer, c.query, u) }
+		}
+		for _, u := range c.hidden {
+			if strings.Contains(body, `"user_id":"`+u+`"`) { t.Errorf("%q %s: shows %s", c.viewer, c.query, u) }
+		}
+	}
+}
+
+func TestExportVisibility(t *testing.T) {
+	s := visibilityFixture(t)
+	if err := s.grantPoints("U1", 5, "more"); err != nil { t.Fatal(err) }
+	_, err := s.db.Exec(`insert into quests(id, name, difficulty, completed, completed_by) values('T1','secret','easy',true,'U1')`)
+	if err != nil { t.Fatal(err) }
+	viewer := "U2"
+	f := exportFilter{viewer: &viewer}
+
+	var buf bytes.Buffer
+	if err := s.exportLeaderboardCSV(&buf, f); err != nil { t.Fatal(err) }
+	//U1 is first and hidden, the others keep rank 2
+	if got := buf.String(); got != "rank,user_id,name,points\n2,U2,U2,1\n2,U3,U3,1\n" { t.Errorf("leaderboard.csv:\n%s", got) }
+
+	buf.Reset()
+	if err := s.exportQuestsCSV(&buf, f); err != nil { t.Fatal(err) }
+	if !strings.Contains(buf.String(), "T1,secret,easy,true,,,") { t.Errorf("quests.csv:\n%s", buf.String()) }
+
+	buf.Reset()
+	if err := s.exportLedgerNDJSON(&buf, f); err != nil { t.Fatal(err) }
+	if strings.Contains(buf.String(), `"U1"`) || strings.Count(buf.String(), "\n") != 2 { t.Errorf("ledger:\n%s", buf.String()) }
+
+	//the cli has no viewer and sees everyone
+	buf.Reset()
+	if err := s.exportLedgerNDJSON(&buf, exportFilter{}); err != nil { t.Fatal(err) }
+	if n := strings.Count(buf.String(), "\n"); n != 4 { t.Errorf("cli ledger has %d lines, want 4", n) }
+}
+
+func TestLeaderboardVisibility(t *testing.T) {
+	s := visibilityFixture(t)
+	if err := s.grantPoints("U1", 5, "more"); err != nil { t.Fatal(err) }
+	cases := []struct {
+		viewer, want string
+	}{
+		//U1 is first and hidden, the others keep rank 2
+		{"", `[{"user_id":"U3","name":"U3","points":1,"rank":2}]`},
+		{"U2", `[{"user_id":"U2","name":"U2","points":1,"rank":2},{"user_id":"U3","name":"U3","points":1,"rank":2}]`},
+		{"U1", `[{"user_id":"U1","name":"U1","points":6,"rank":1},{"user_id":"U2","name":"U2","points":1,"rank":2},{"user_id":"U3","name":"U3","points":1,"rank":2}]`},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		s.handleLeaderboard(rec, signedIn(t, s, httptest.NewRequest("GET", "/leaderboard", nil), c.viewer))
+		if got := strings.TrimSpace(rec.Body.String()); got != c.want { t.Errorf("%q: %s, want %s", c.viewer, got, c.want) }
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleLeaderboardMe(rec, signedIn(t, s, httptest.NewRequest("GET", "/leaderboard/me?n=1", nil), "U2"))
+	if rec.Code != 200 || strings.Contains(rec.Body.String(), `"U1"`) { t.Errorf("me for U2: %d %s", rec.Code, rec.Body) }
+}
+
+func TestEventsVisibility(t *testing.T) {
+	s := visibilityFixture(t)
+	ch := s.hub.subscribe()
+	defer s.hub.unsubscribe(ch)
+	if err := s.grantPoints("U1", 5, "more"); err != nil { t.Fatal(err) }
+
+	var n int
+	for len(ch) > 0 {
+		ev := <-ch
+		if ev.UserID != "U1" { t.Errorf("%s event about %q", ev.Kind, ev.UserID); continue }
+		n++
+		if !ev.seenBy("U1") || ev.seenBy("U2") || ev.seenBy("") { t.Errorf("%s event visible to the wrong viewers", ev.Kind) }
+	}
+	if n == 0 { t.Error("no events published") }
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type recomputeOpts struct {
+	source string // "quests" or "ledger"
+	dryRun bool
+	batch  int  // 0 means one transaction for everyone
+	resume bool // continue a batched run from its checkpoint
+}
+
+type rankChange struct {
+	UserID            string
+	Name              string
+	OldPoints, Points float64
+	OldRank, Rank     int
+}
+
+//checkpoint name for batched runs
+const recomputeJob = "recompute_scores"
+
+func ensureRecomputeTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS job_checkpoints (
+		  name TEXT PRIMARY KEY,
+		  cursor TEXT NOT NULL,
+		  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+	`)
+	return err
+}
+
+func ensureRecomputeTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS job_checkpoints (
+		  name TEXT PRIMARY KEY,
+		  cursor TEXT NOT NULL,
+		  updated_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`
+		);
+	`)
+	return err
+}
+
+func pointsSource(source string) (string, error) {
+	switch source {
+	case "", "quests":
+		return questPointsSQL, nil
+	case "ledger":
+		return ledgerPointsSQL, nil
+	}
+	return "", fmt.Errorf("unknown source %q, want quests or ledger", source)
+}
+
+//every user whose points or rank would change if scores were rebuilt from src
+func (s *server) rankChanges(src string) ([]rankChange, error) {
+	rows, err := s.db.Query(`
+		with fresh as (` + src + `),
+		board as (
+		  select u.id, u.name, coalesce(sc.points,0) as old_points, f.points
+		  from users u
+		  join fresh f on f.user_id = u.id
+		  left join scores sc on sc.user_id = u.id
+		),
+		ranked as (
+		  select *, rank() over (order by old_points desc) as old_rank,
+		            rank() over (order by points desc) as new_rank
+		  from board
+		)
+		select id, name, old_points, points, old_rank, new_rank
+		from ranked
+		where old_points <> points or old_rank <> new_rank
+		order by new_rank, name`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	var out []rankChange
+	for rows.Next() {
+		var c rankChange
+		if err := rows.Scan(&c.UserID, &c.Name, &c.OldPoints, &c.Points, &c.OldRank, &c.Rank); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+//rebuilds every score. the rank diff is always written to out, dry runs stop there
+func (s *server) recomputeAll(opts recomputeOpts, out io.Writer) error {
+	src, err := pointsSource(opts.source)
+	if err != nil { return err }
+
+	changes, err := s.rankChanges(src)
+	if err != nil { return err }
+	for _, c := range changes {
+		fmt.Fprintf(out, "%-24s #%d -> #%d  (%g -> %g pts)\n", c.Name, c.OldRank, c.Rank, c.OldPoints, c.Points)
+	}
+	fmt.Fprintf(out, "%d users change\n", len(changes))
+	if opts.dryRun { return nil }
+
+	if opts.batch > 0 {
+		err = s.recomputeBatches(src, opts.batch, opts.resume, out)
+	} else {
+		err = s.recomputeTx(src)
+	}
+	if err != nil { return err }
+	if len(changes) > 0 {
+		s.publish("leaderboard", "", map[string]any{"recomputed": true, "changed": len(changes)})
+	}
+	return nil
+}
+
+//all or nothing, fine for boards with a few thousand players
+func (s *server) recomputeTx(src string) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		insert into scores(user_id, points)
+		select user_id, points from (` + src + `) p where true
+		on conflict (user_id) do update set points=excluded.points`)
+	if err != nil { return err }
+	return tx.Commit()
+}
+
+//commits n users at a time in id order and checkpoints the last id, so an
+//interrupted run picks up where it stopped with resume
+func (s *server) recomputeBatches(src string, n int, resume bool, out io.Writer) error {
+	cursor := ""
+	if resume {
+		err := s.db.QueryRow(`select cursor from job_checkpoints where name=$1`, recomputeJob).Scan(&cursor)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) { return err }
+		if cursor != "" { fmt.Fprintf(out, "resuming after %s\n", cursor) }
+	}
+
+	for {
+		rows, err := s.db.Query(`select id from users where id > $1 order by id limit $2`, cursor, n)
+		if err != nil { return err }
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil { rows.Close(); return err }
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil { return err }
+		if len(ids) == 0 { break }
+
+		tx, err := s.db.Begin()
+		if err != nil { return err }
+		_, err = tx.Exec(`
+			insert into scores(user_id, points)
+			select user_id, points from (`+src+`) p where user_id > $1 and user_id <= $2
+			on conflict (user_id) do update set points=excluded.points`, cursor, ids[len(ids)-1])
+		if err == nil {
+			cursor = ids[len(ids)-1]
+			_, err = tx.Exec(`insert into job_checkpoints(name, cursor, updated_at) values($1,$2,$3)
+				on conflict (name) do update set cursor=excluded.cursor, updated_at=excluded.updated_at`,
+				recomputeJob, cursor, time.Now())
+		}
+		if err == nil { err = tx.Commit() }
+		if err != nil { tx.Rollback(); return err }
+		fmt.Fprintf(out, "batch done through %s\n", cursor)
+	}
+
+	_, err := s.db.Exec(`delete from job_checkpoints where name=$1`, recomputeJob)
+	return err
+}
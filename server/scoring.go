@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+//points per user: current difficulty weights over completed quests, times the
+//due date multiplier fixed at completion, plus manual grants, bounties and review xp
+const questPointsSQL = `
+	select u.id as user_id,
+	  coalesce((select sum(dw.weight * q.multiplier)
+	    from quests q
+	    join difficulty_weights dw on dw.difficulty = q.difficulty
+	    where q.completed and q.completed_by = u.id), 0)
+	  + coalesce((select sum(a.points) from activity a where a.user_id = u.id and a.kind in ('grant', 'bounty', 'review')), 0) as points
+	from users u`
+
+//points per user replayed from the activity ledger, keeps whatever weight applied when earned
+const ledgerPointsSQL = `
+	select u.id as user_id, coalesce((select sum(a.points) from activity a where a.user_id = u.id), 0) as points
+	from users u`
+
+//the scoring step of migrate, on a fresh postgres docker/postgres/init.sql already made these
+func ensureScoringTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS difficulty_weights (
+		  difficulty TEXT PRIMARY KEY,
+		  weight REAL NOT NULL
+		);
+
+		INSERT INTO difficulty_weights(difficulty, weight) VALUES
+		  ('easy', 1.0), ('medium', 2.0), ('hard', 3.0)
+		ON CONFLICT (difficulty) DO NOTHING;
+
+		CREATE TABLE IF NOT EXISTS quests (
+		  id TEXT PRIMARY KEY,
+		  name TEXT NOT NULL,
+		  difficulty TEXT NOT NULL REFERENCES difficulty_weights(difficulty),
+		  completed BOOLEAN NOT NULL DEFAULT false,
+		  completed_by TEXT REFERENCES users(id),
+		  completed_at TIMESTAMPTZ
+		);
+
+		ALTER TABLE quests ADD COLUMN IF NOT EXISTS project_id TEXT;
+
+		CREATE TABLE IF NOT EXISTS sync_status (
+		  project_id TEXT PRIMARY KEY,
+		  last_success_at TIMESTAMPTZ,
+		  last_error TEXT,
+		  last_error_at TIMESTAMPTZ
+		);
+	`)
+	return err
+}
+
+func ensureScoringTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS difficulty_weights (
+		  difficulty TEXT PRIMARY KEY,
+		  weight REAL NOT NULL
+		);
+
+		INSERT INTO difficulty_weights(difficulty, weight) VALUES
+		  ('easy', 1.0), ('medium', 2.0), ('hard', 3.0)
+		ON CONFLICT (difficulty) DO NOTHING;
+
+		--columns later postgres steps add with ALTER TABLE are inline here
+		CREATE TABLE IF NOT EXISTS quests (
+		  id TEXT PRIMARY KEY,
+		  name TEXT NOT NULL,
+		  difficulty TEXT NOT NULL REFERENCES difficulty_weights(difficulty),
+		  completed BOOLEAN NOT NULL DEFAULT false,
+		  completed_by TEXT REFERENCES users(id),
+		  completed_at TIMESTAMP,
+		  project_id TEXT,
+		  assignee_id TEXT REFERENCES users(id),
+		  due_at TIMESTAMP,
+		  multiplier REAL NOT NULL DEFAULT 1,
+		  section TEXT,
+		  state TEXT
+		);
+
+		CREATE TABLE IF NOT EXISTS sync_status (
+		  project_id TEXT PRIMARY KEY,
+		  last_success_at TIMESTAMP,
+		  last_error TEXT,
+		  last_error_at TIMESTAMP
+		);
+	`)
+	return err
+}
+
+//pulls the quest board from asana into quests, then rebuilds the score of
+//the user and of anyone who finished a quest since the last sync
+func (s *server) recomputePointsForUser(ctx context.Context, t *asanaTokens, userID string) error {
+	projectGID := s.cfg.AsanaProjectID
+	if projectGID == "" {
+		return errors.New("missing ASANA_PROJECT_ID")
+	}
+	completers, err := s.syncProject(ctx, t, projectGID)
+	if err != nil { return err }
+
+	touched := map[string]bool{userID: true}
+	for _, uid := range completers { touched[uid] = true }
+	for uid := range touched {
+		if err := s.rescoreUser(uid); err != nil { return err }
+	}
+	return nil
+}
+
+//mirrors every task of the project into quests, returns who newly completed one
+func (s *server) syncProject(ctx context.Context, t *asanaTokens, projectGID string) ([]string, error) {
+	completers, err := s.syncProjectTasks(ctx, t, projectGID)
+	s.recordSync(projectGID, err)
+	return completers, err
+}
+
+func (s *server) syncProjectTasks(ctx context.Context, t *asanaTokens, projectGID string) ([]string, error) {
+	tasks, err := s.listAllProjectTasks(ctx, t, projectGID)
+	if err != nil { return nil, err }
+	sections, err := s.sectionStates(projectGID)
+	if err != nil { return nil, err }
+	var completers []string
+	for _, task := range tasks {
+		by, err := s.upsertQuest(projectGID, sections, task)
+		if err != nil { return nil, err }
+		if by != "" { completers = append(completers, by) }
+	}
+	return completers, nil
+}
+
+//keeps sync_status current for readiness checks and the lag gauge
+func (s *server) recordSync(projectGID string, syncErr error) {
+	var err error
+	if syncErr == nil {
+		syncLastSuccess.WithLabelValues(projectGID).SetToCurrentTime()
+		_, err = s.db.Exec(`insert into sync_status(project_id, last_success_at) values($1,$2)
+			on conflict (project_id) do update set last_success_at=excluded.last_success_at`, projectGID, time.Now())
+	} else {
+		_, err = s.db.Exec(`insert into sync_status(project_id, last_error, last_error_at) values($1,$2,$3)
+			on conflict (project_id) do update set last_error=excluded.last_error, last_error_at=excluded.last_error_at`,
+			projectGID, syncErr.Error(), time.Now())
+	}
+	if err != nil { slog.Warn("record sync status", "project", projectGID, "err", err) }
+}
+
+//mirrors one asana task into quests. returns the completer's gid when the
+//task just flipped to completed so the caller can rescore them
+func (s *server) upsertQuest(projectGID string, sections map[string]string, t asanaTask) (string, error) {
+	var completedBy, assignee *string
+	if t.Assignee != nil {
+		//assignee_id and completed_by reference users so make sure the assignee exists
+		avatar := ""
+		if t.Assignee.Photo != nil { avatar = t.Assignee.Photo.Image128 }
+		_, err := s.db.Exec(`insert into users(id, name, avatar_url) values($1,$2,nullif($3,''))
+			on conflict (id) do update set avatar_url=coalesce(excluded.avatar_url, users.avatar_url)`,
+			t.Assignee.Gid, t.Assignee.Name, avatar)
+		if err != nil { return "", err }
+		assignee = &t.Assignee.Gid
+		if t.Completed { completedBy = &t.Assignee.Gid }
+	}
+
+	//the row lock orders this against a completion from the board, so only
+	//one of them finds the completion unpaid
+	tx, err := s.db.Begin()
+	if err != nil { return "", err }
+	defer tx.Rollback()
+
+	var oldState string
+	err = tx.QueryRow(`select coalesce(state,'') from quests where id=$1`+s.cfg.forUpdate(), t.Gid).Scan(&oldState)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { return "", err }
+	section := taskSection(t, projectGID)
+	state := questState(sections, section, t.Completed)
+
+	difficulty := questDifficulty(t)
+	_, err = tx.Exec(`
+		insert into quests(id, name, difficulty, completed, completed_by, completed_at, project_id, assignee_id, due_at, section, state)
+		values($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
+		on conflict (id) do update set
+		  name=excluded.name,
+		  project_id=excluded.project_id,
+		  difficulty=excluded.difficulty,
+		  completed=excluded.completed,
+		  completed_by=excluded.completed_by,
+		  completed_at=excluded.completed_at,
+		  assignee_id=excluded.assignee_id,
+		  due_at=excluded.due_at,
+		  section=excluded.section,
+		  state=excluded.state`,
+		t.Gid, t.Name, difficulty, t.Completed, completedBy, t.CompletedAt, projectGID, assignee, taskDueAt(t), section, state)
+	if err != nil { return "", err }
+	if err := recordTransition(tx, t.Gid, assignee, oldState, state); err != nil { return "", err }
+
+	//a claim ends when the quest is done or someone reassigns it in asana
+	_, err = tx.Exec(`delete from quest_claims
+		where quest_id=$1 and exists(select 1 from quests q where q.id=quest_claims.quest_id
+		  and (q.completed or q.assignee_id is distinct from quest_claims.user_id))`, t.Gid)
+	if err != nil { return "", err }
+
+	//the ledger, not the completed flag, says whether the completion was paid,
+	//so a quest the board marked done but failed to award gets paid here
+	var awarded []activityEvent
+	if completedBy != nil {
+		awarded, err = s.awardCompletion(tx, t.Gid, *completedBy, difficulty, "sync")
+		if err != nil { return "", err }
+	}
+	if err := tx.Commit(); err != nil { return "", err }
+	s.announce(awarded...)
+
+	if state != oldState {
+		if err := s.afterTransition(t.Gid, assignee, state); err != nil { return "", err }
+	}
+	if len(awarded) == 0 { return "", nil }
+	return *completedBy, nil
+}
+
+//puts a completion in the ledger at the current weight, inside the tx that
+//holds the quest row so the flag and the payout commit together. a quest pays
+//out once per user, so a completion that was already paid is a no-op. the
+//events are for announce after the commit
+func (s *server) awardCompletion(tx *sql.Tx, questID, userID, difficulty, source string) ([]activityEvent, error) {
+	var seen bool
+	err := tx.QueryRow(`select exists(select 1 from activity
+		where kind=$1 and quest_id=$2 and user_id=$3)`, activityQuestCompleted, questID, userID).Scan(&seen)
+	if err != nil || seen { return nil, err }
+
+	var weight float64
+	if err := tx.QueryRow(`select weight from difficulty_weights where difficulty=$1`, difficulty).Scan(&weight); err != nil {
+		return nil, err
+	}
+
+	//due date rules are judged once, at completion, and the multiplier is kept
+	//on the quest so rescoring from quests agrees with the ledger
+	var due, doneAt *time.Time
+	err = tx.QueryRow(`select due_at, completed_at from quests where id=$1`, questID).Scan(&due, &doneAt)
+	if err != nil { return nil, err }
+	if doneAt == nil { now := time.Now(); doneAt = &now }
+	mods := s.cfg.dueModifiers(due, *doneAt)
+	mult := totalMultiplier(mods)
+	if _, err := tx.Exec(`update quests set multiplier=$2 where id=$1`, questID, mult); err != nil { return nil, err }
+
+	//the row is dated when the quest was done so it lands in the right week and
+	//season. a sync that finds a completion older than a healthy sync could lag
+	//behind is catching up on history, not announcing news
+	ev, err := insertActivityAt(tx, *doneAt, activityQuestCompleted, userID, questID, weight*mult, map[string]any{
+		"difficulty": difficulty,
+		"source":     source,
+		"base":       weight,
+		"modifiers":  mods,
+	})
+	if err != nil { return nil, err }
+	ev.backfill = source == "sync" && time.Since(*doneAt) > s.cfg.SyncStaleAfter
+	evs := []activityEvent{ev}
+	b, err := awardBounty(tx, questID, userID)
+	if err != nil { return nil, err }
+	return append(evs, b...), nil
+}
+
+//rebuilds scores.points for one user from the quests they completed plus manual grants.
+//scores are derived from the ledger, so like the ledger they live in s.db
+func (s *server) rescoreUser(userID string) error {
+	before, err := s.rankOf(userID)
+	if err != nil { return err }
+
+	var old, points float64
+	err = s.db.QueryRow(`select coalesce((select points from scores where user_id=$1), 0)`, userID).Scan(&old)
+	if err != nil { return err }
+	err = s.db.QueryRow(`select points from (`+questPointsSQL+`) p where user_id = $1`, userID).Scan(&points)
+	if err != nil { return err }
+	_, err = s.db.Exec(`insert into scores(user_id, points) values($1,$2)
+		on conflict (user_id) do update set points=excluded.points`, userID, points)
+	if err != nil { return err }
+
+	after, err := s.rankOf(userID)
+	if err != nil { return err }
+	if points != old || after != before {
+		s.publish("leaderboard", userID, map[string]any{
+			"user_id": userID,
+			"points":  points,
+			"delta":   points - old,
+			"rank":    after,
+		})
+	}
+	if after < before {
+		err := s.recordActivity(activityRankUp, userID, "", 0, map[string]any{
+			"from": before,
+			"to":   after,
+		})
+		if err != nil { return err }
+	}
+	return s.checkBadges(userID)
+}
+
+//manual adjustment, kept in activity so rescoring doesn't wipe it
+func (s *server) grantPoints(userID string, points float64, reason string) error {
+	err := s.recordActivity(activityGrant, userID, "", points, map[string]any{"reason": reason})
+	if err != nil { return err }
+	return s.rescoreUser(userID)
+}
+
+//1-based competition rank, users without a score row rank as 0 points
+func (s *server) rankOf(userID string) (int, error) {
+	var rank int
+	err := s.db.QueryRow(`
+		select 1 + count(*) from scores
+		where points > coalesce((select points from scores where user_id=$1), 0)`, userID).Scan(&rank)
+	return rank, err
+}
+
+//name, points and rank for one user
+func (s *server) userStanding(userID string) (leaderboardRow, int, error) {
+	row := leaderboardRow{UserID: userID}
+	err := s.db.QueryRow(`
+		select u.name, coalesce(sc.points,0)
+		from users u
+		left join scores sc on sc.user_id = u.id
+		where u.id=$1`, userID).Scan(&row.Name, &row.Points)
+	if err != nil { return row, 0, err }
+	rank, err := s.rankOf(userID)
+	row.Rank = rank
+	return row, rank, err
+}
+
+//difficulty comes from the "Difficulty" custom field, anything unknown counts as easy
+func questDifficulty(t asanaTask) string {
+	v, _ := extractCustom(t.CustomFields, "Difficulty")
+	switch d := strings.ToLower(strings.TrimSpace(v)); d {
+	case "easy", "medium", "hard":
+		return d
+	}
+	return "easy"
+}
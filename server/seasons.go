@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//a stretch of the ledger with its own standings. exactly one season is open,
+//closing it archives the standings and opens the next one
+type season struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+}
+
+type seasonStanding struct {
+	SeasonID int64   `json:"season_id"`
+	UserID   string  `json:"user_id"`
+	Name     string  `json:"name"`
+	Rank     int     `json:"rank"`
+	Points   float64 `json:"points"`
+}
+
+//where a user finished a season, or stands in the open one
+type seasonResult struct {
+	SeasonID int64   `json:"season_id"`
+	Season   string  `json:"season"`
+	Rank     int     `json:"rank"`
+	Points   float64 `json:"points"`
+}
+
+var errNoSeason = errors.New("season not found")
+
+//the first season starts with the oldest ledger row so nothing earned before
+//seasons existed falls outside of one
+func ensureSeasonTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS seasons (
+		  id BIGSERIAL PRIMARY KEY,
+		  name TEXT NOT NULL,
+		  started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		  ended_at TIMESTAMPTZ
+		);
+
+		CREATE TABLE IF NOT EXISTS season_standings (
+		  season_id BIGINT NOT NULL REFERENCES seasons(id),
+		  user_id TEXT NOT NULL REFERENCES users(id),
+		  rank INT NOT NULL,
+		  points NUMERIC NOT NULL,
+		  PRIMARY KEY (season_id, user_id)
+		);
+
+		INSERT INTO seasons(name, started_at)
+		SELECT 'Season 1', coalesce((SELECT min(created_at) FROM activity), now())
+		WHERE NOT EXISTS (SELECT 1 FROM seasons);
+	`)
+	return err
+}
+
+func ensureSeasonTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS seasons (
+		  id INTEGER PRIMARY KEY,
+		  name TEXT NOT NULL,
+		  started_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`,
+		  ended_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS season_standings (
+		  season_id INTEGER NOT NULL REFERENCES seasons(id),
+		  user_id TEXT NOT NULL REFERENCES users(id),
+		  rank INT NOT NULL,
+		  points REAL NOT NULL,
+		  PRIMARY KEY (season_id, user_id)
+		);
+
+		INSERT INTO seasons(name, started_at)
+		SELECT 'Season 1', coalesce((SELECT min(created_at) FROM activity), `+sqliteNow+`)
+		WHERE NOT EXISTS (SELECT 1 FROM seasons);
+	`)
+	return err
+}
+
+const seasonCols = `id, name, started_at, ended_at`
+
+func scanSeason(row interface{ Scan(...any) error }) (*season, error) {
+	var se season
+	if err := row.Scan(&se.ID, &se.Name, &se.StartedAt, &se.EndedAt); err != nil { return nil, err }
+	return &se, nil
+}
+
+func (s *server) currentSeason() (*season, error) {
+	se, err := scanSeason(s.db.QueryRow(`select ` + seasonCols + ` from seasons
+		where ended_at is null order by id desc limit 1`))
+	if errors.Is(err, sql.ErrNoRows) { return nil, errNoSeason }
+	return se, err
+}
+
+//"current" or a season id, as taken by ?season= and --season
+func (s *server) seasonByRef(ref string) (*season, error) {
+	if ref == "current" { return s.currentSeason() }
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil { return nil, errors.New("season must be an id or current") }
+	se, err := scanSeason(s.db.QueryRow(`select `+seasonCols+` from seasons where id=$1`, id))
+	if errors.Is(err, sql.ErrNoRows) { return nil, errNoSeason }
+	return se, err
+}
+
+//season points are whatever the ledger paid out while the season was open
+const seasonPointsSQL = `
+	select a.user_id, sum(a.points) as points,
+	  rank() over (order by sum(a.points) desc) as rank
+	from activity a
+	where a.created_at >= $1 and a.created_at < $2
+	group by a.user_id
+	having sum(a.points) > 0`
+
+//the open season so far (rank 0 without points in it) and every closed
+//season the user placed in, newest first
+func (s *server) seasonStats(userID string) (*seasonResult, []seasonResult, error) {
+	cur, err := s.currentSeason()
+	if err != nil { return nil, nil, err }
+	now := &seasonResult{SeasonID: cur.ID, Season: cur.Name}
+	err = s.db.QueryRow(`with pts as (`+seasonPointsSQL+`)
+		select rank, points from pts where user_id=$3`, cur.StartedAt, time.Now(), userID).Scan(&now.Rank, &now.Points)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { return nil, nil, err }
+
+	rows, err := s.db.Query(`
+		select st.season_id, se.name, st.rank, st.points
+		from season_standings st
+		join seasons se on se.id = st.season_id
+		where st.user_id=$1
+		order by st.season_id desc`, userID)
+	if err != nil { return nil, nil, err }
+	defer rows.Close()
+	past := []seasonResult{}
+	for rows.Next() {
+		var res seasonResult
+		if err := rows.Scan(&res.SeasonID, &res.Season, &res.Rank, &res.Points); err != nil { return nil, nil, err }
+		past = append(past, res)
+	}
+	return now, past, rows.Err()
+}
+
+//archives the open season's standings, ends it and opens the next one named
+//name ("Season N" when empty). every placed player gets a season activity row
+func (s *server) closeSeason(name string) (*season, []seasonStanding, error) {
+	tx, err := s.db.Begin()
+	if err != nil { return nil, nil, err }
+	defer tx.Rollback()
+
+	cur, err := scanSeason(tx.QueryRow(`select ` + seasonCols + ` from seasons
+		where ended_at is null order by id desc limit 1` + s.cfg.forUpdate()))
+	if errors.Is(err, sql.ErrNoRows) { return nil, nil, errNoSeason }
+	if err != nil { return nil, nil, err }
+	//sqlite keeps milliseconds, round up so rows written in this millisecond
+	//still count for the season being closed
+	now := time.Now().Truncate(time.Millisecond).Add(time.Millisecond)
+
+	rows, err := tx.Query(`with pts as (`+seasonPointsSQL+`)
+		select pts.user_id, u.name, pts.rank, pts.points
+		from pts join users u on u.id = pts.user_id
+		order by pts.rank, u.name`, cur.StartedAt, now)
+	if err != nil { return nil, nil, err }
+	var standings []seasonStanding
+	for rows.Next() {
+		st := seasonStanding{SeasonID: cur.ID}
+		if err := rows.Scan(&st.UserID, &st.Name, &st.Rank, &st.Points); err != nil { rows.Close(); return nil, nil, err }
+		standings = append(standings, st)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return nil, nil, err }
+
+	var events []activityEvent
+	for _, st := range standings {
+		_, err := tx.Exec(`insert into season_standings(season_id, user_id, rank, points) values($1,$2,$3,$4)`,
+			st.SeasonID, st.UserID, st.Rank, st.Points)
+		if err != nil { return nil, nil, err }
+		//points stay in the ledger where they were earned, this row only marks the finish
+		ev, err := insertActivity(tx, activitySeason, st.UserID, "", 0, map[string]any{
+			"season_id": cur.ID,
+			"season":    cur.Name,
+			"rank":      st.Rank,
+			"points":    st.Points,
+		})
+		if err != nil { return nil, nil, err }
+		events = append(events, ev)
+	}
+
+	if _, err := tx.Exec(`update seasons set ended_at=$2 where id=$1`, cur.ID, now); err != nil { return nil, nil, err }
+	if name == "" {
+		var n int
+		if err := tx.QueryRow(`select count(*) from seasons`).Scan(&n); err != nil { return nil, nil, err }
+		name = fmt.Sprintf("Season %d", n+1)
+	}
+	next := &season{Name: name, StartedAt: now}
+	err = tx.QueryRow(`insert into seasons(name, started_at) values($1,$2) returning id`, name, now).Scan(&next.ID)
+	if err != nil { return nil, nil, err }
+	if err := tx.Commit(); err != nil { return nil, nil, err }
+
+	s.announce(events...)
+	cur.EndedAt = &now
+	s.publish("season_closed", "", map[string]any{"season": cur, "next": next, "standings": len(standings)})
+	for _, st := range standings {
+		if st.Rank != 1 { break }
+		if err := s.checkBadges(st.UserID); err != nil { return nil, nil, err }
+	}
+	return next, standings, nil
+}
+
+func (s *server) mountSeasons(mux *http.ServeMux) {
+	mux.HandleFunc("GET /seasons", s.handleListSeasons)
+}
+
+//GET /seasons
+//newest first, the open one has no ended_at
+func (s *server) handleListSeasons(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query(`select ` + seasonCols + ` from seasons order by id desc`)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	defer rows.Close()
+	out := []season{}
+	for rows.Next() {
+		se, err := scanSeason(rows)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		out = append(out, *se)
+	}
+	writeJSON(w, out)
+}
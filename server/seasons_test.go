@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCloseSeason(t *testing.T) {
+	s := newSQLiteTestServer(t)
+	first, err := s.currentSeason()
+	if err != nil { t.Fatal(err) }
+	for _, u := range []string{"U1", "U2", "U3"} {
+		if _, err := s.db.Exec(`insert into users(id, name) values($1,$1)`, u); err != nil { t.Fatal(err) }
+	}
+	if err := s.grantPoints("U1", 5, "setup"); err != nil { t.Fatal(err) }
+	if err := s.grantPoints("U2", 8, "setup"); err != nil { t.Fatal(err) }
+
+	next, standings, err := s.closeSeason("")
+	if err != nil { t.Fatal(err) }
+	if next.Name != "Season 2" || next.ID == first.ID { t.Errorf("next season = %+v", next) }
+	if len(standings) != 2 || standings[0].UserID != "U2" || standings[0].Rank != 1 || standings[1].Points != 5 {
+		t.Errorf("standings = %+v", standings)
+	}
+	if n := countActivity(t, s, activitySeason, "U2"); n != 1 { t.Errorf("U2 season rows = %d", n) }
+	if n := countActivity(t, s, activitySeason, "U3"); n != 0 { t.Errorf("U3 placed without points") }
+
+	cur, err := s.currentSeason()
+	if err != nil || cur.ID != next.ID { t.Fatalf("current = %+v, %v", cur, err) }
+	closed, err := s.seasonByRef(strconv.FormatInt(first.ID, 10))
+	if err != nil || closed.EndedAt == nil { t.Fatalf("first season = %+v, %v", closed, err) }
+
+	//points after the close belong to the new season only
+	if err := s.grantPoints("U3", 2, "late"); err != nil { t.Fatal(err) }
+	bq, err := s.parseBoardQuery(httptest.NewRequest("GET", "/leaderboard?window=season", nil))
+	if err != nil { t.Fatal(err) }
+	board, err := s.leaderboardPage(bq, 10, 0)
+	if err != nil { t.Fatal(err) }
+	if board[0].UserID != "U3" || board[0].Points != 2 || board[1].Points != 0 { t.Errorf("season board = %+v", board) }
+
+	f, err := s.parseExportFilter(url.Values{"season": {"current"}})
+	if err != nil { t.Fatal(err) }
+	var buf bytes.Buffer
+	if err := s.exportLeaderboardCSV(&buf, f); err != nil { t.Fatal(err) }
+	if !strings.HasPrefix(buf.String(), "rank,user_id,name,points\n1,U3,U3,2\n") { t.Errorf("current season export:\n%s", buf.String()) }
+
+	if _, err := s.parseExportFilter(url.Values{"season": {"1"}, "from": {"2025-01-01"}}); err == nil {
+		t.Error("season and from together should be rejected")
+	}
+	if _, err := s.parseExportFilter(url.Values{"season": {"99"}}); err != errNoSeason {
+		t.Errorf("unknown season: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+//where a quest sits on the board, from its asana section
+const (
+	stateBacklog    = "backlog"
+	stateAvailable  = "available"
+	stateInProgress = "in_progress"
+	stateReview     = "review"
+	stateDone       = "done"
+)
+
+//what a section can be mapped to, done comes from completing the task
+var sectionStateChoices = []string{stateBacklog, stateAvailable, stateInProgress, stateReview}
+
+var questCycleTime = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "questboard_quest_cycle_time_seconds",
+	Help:    "Time from a quest first entering in progress to done.",
+	Buckets: prometheus.ExponentialBuckets(3600, 2, 12),
+})
+
+func ensureSectionTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		ALTER TABLE quests ADD COLUMN IF NOT EXISTS section TEXT;
+		ALTER TABLE quests ADD COLUMN IF NOT EXISTS state TEXT;
+
+		CREATE TABLE IF NOT EXISTS section_states (
+		  project_id TEXT NOT NULL,
+		  section TEXT NOT NULL,
+		  state TEXT NOT NULL,
+		  PRIMARY KEY (project_id, section)
+		);
+
+		CREATE TABLE IF NOT EXISTS quest_transitions (
+		  id BIGSERIAL PRIMARY KEY,
+		  quest_id TEXT NOT NULL REFERENCES quests(id) ON DELETE CASCADE,
+		  user_id TEXT REFERENCES users(id),
+		  from_state TEXT,
+		  to_state TEXT NOT NULL,
+		  at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS quest_transitions_quest_idx ON quest_transitions(quest_id, at);
+	`)
+	return err
+}
+
+//quests.section and quests.state are inline in the sqlite quests table
+func ensureSectionTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS section_states (
+		  project_id TEXT NOT NULL,
+		  section TEXT NOT NULL,
+		  state TEXT NOT NULL,
+		  PRIMARY KEY (project_id, section)
+		);
+
+		CREATE TABLE IF NOT EXISTS quest_transitions (
+		  id INTEGER PRIMARY KEY,
+		  quest_id TEXT NOT NULL REFERENCES quests(id) ON DELETE CASCADE,
+		  user_id TEXT REFERENCES users(id),
+		  from_state TEXT,
+		  to_state TEXT NOT NULL,
+		  at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`
+		);
+		CREATE INDEX IF NOT EXISTS quest_transitions_quest_idx ON quest_transitions(quest_id, at);
+	`)
+	return err
+}
+
+//the board's own mapping first, then a guess from common words in the column
+//name. only completing the task makes it done, whatever column it sits in
+func questState(sections map[string]string, section string, completed bool) string {
+	if completed { return stateDone }
+	if st, ok := sections[section]; ok && st != stateDone { return st }
+	words := strings.FieldsFunc(strings.ToLower(section), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	has := func(ws ...string) bool {
+		return slices.ContainsFunc(ws, func(w string) bool { return slices.Contains(words, w) })
+	}
+	switch {
+	case has("backlog", "icebox", "later"):
+		return stateBacklog
+	case has("progress", "doing", "wip"):
+		return stateInProgress
+	case has("review", "qa"):
+		return stateReview
+	}
+	return stateAvailable
+}
+
+//the section name of the task's membership in this project
+func taskSection(t asanaTask, projectGID string) string {
+	for _, m := range t.Memberships {
+		if m.Project.Gid == projectGID && m.Section != nil { return m.Section.Name }
+	}
+	return ""
+}
+
+func (s *server) sectionStates(projectGID string) (map[string]string, error) {
+	rows, err := s.db.Query(`select section, state from section_states where project_id=$1`, projectGID)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := map[string]string{}
+	for rows.Next() {
+		var sec, st string
+		if err := rows.Scan(&sec, &st); err != nil { return nil, err }
+		out[sec] = st
+	}
+	return out, rows.Err()
+}
+
+//logs a state change inside the caller's transaction. from is "" for a new quest
+func recordTransition(tx *sql.Tx, questID string, userID *string, from, to string) error {
+	if from == to { return nil }
+	var fromState *string
+	if from != "" { fromState = &from }
+	_, err := tx.Exec(`insert into quest_transitions(quest_id, user_id, from_state, to_state) values($1,$2,$3,$4)`,
+		questID, userID, fromState, to)
+	return err
+}
+
+//runs after a transition committed: the cycle time histogram and the
+//optional review xp, paid once per quest and user
+func (s *server) afterTransition(questID string, userID *string, to string) error {
+	switch to {
+	case stateDone:
+		if c, err := s.cycleOf(questID); err == nil && c.CycleTime != nil {
+			questCycleTime.Observe(c.CycleTime.Seconds())
+		}
+	case stateReview:
+		if s.cfg.ReviewXP <= 0 || userID == nil { return nil }
+		var seen bool
+		err := s.db.QueryRow(`select exists(select 1 from activity
+			where kind=$1 and quest_id=$2 and user_id=$3)`, activityReview, questID, *userID).Scan(&seen)
+		if err != nil || seen { return err }
+		if err := s.recordActivity(activityReview, *userID, questID, s.cfg.ReviewXP, nil); err != nil { return err }
+		return s.rescoreUser(*userID)
+	}
+	return nil
+}
+
+type questCycle struct {
+	QuestID     string                   `json:"quest_id"`
+	Transitions []questTransition        `json:"transitions"`
+	TimeIn      map[string]time.Duration `json:"-"`
+	//seconds spent in each state, the current state counts up to now
+	TimeInSeconds map[string]float64 `json:"time_in_seconds"`
+	//first in progress to done, nil until both happened
+	CycleTime        *time.Duration `json:"-"`
+	CycleTimeSeconds *float64       `json:"cycle_time_seconds"`
+}
+
+type questTransition struct {
+	From   *string   `json:"from"`
+	To     string    `json:"to"`
+	UserID *string   `json:"user_id,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+func (s *server) cycleOf(questID string) (*questCycle, error) {
+	rows, err := s.db.Query(`select from_state, to_state, user_id, at
+		from quest_transitions where quest_id=$1 order by at, id`, questID)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	c := &questCycle{QuestID: questID, Transitions: []questTransition{}, TimeIn: map[string]time.Duration{}}
+	for rows.Next() {
+		var tr questTransition
+		if err := rows.Scan(&tr.From, &tr.To, &tr.UserID, &tr.At); err != nil { return nil, err }
+		c.Transitions = append(c.Transitions, tr)
+	}
+	if err := rows.Err(); err != nil { return nil, err }
+
+	var started *time.Time
+	for i, tr := range c.Transitions {
+		end := time.Now()
+		if i+1 < len(c.Transitions) { end = c.Transitions[i+1].At }
+		if tr.To != stateDone { c.TimeIn[tr.To] += end.Sub(tr.At) }
+		if tr.To == stateInProgress && started == nil { started = &tr.At }
+		if tr.To == stateDone && started != nil && c.CycleTime == nil {
+			d := tr.At.Sub(*started)
+			c.CycleTime = &d
+		}
+	}
+	c.TimeInSeconds = map[string]float64{}
+	for st, d := range c.TimeIn { c.TimeInSeconds[st] = d.Seconds() }
+	if c.CycleTime != nil {
+		secs := c.CycleTime.Seconds()
+		c.CycleTimeSeconds = &secs
+	}
+	return c, nil
+}
+
+func (s *server) mountSections(mux *http.ServeMux) {
+	mux.HandleFunc("GET /boards/{project}/sections", s.handleGetSections)
+	mux.HandleFunc("PUT /boards/{project}/sections", s.handlePutSections)
+	mux.HandleFunc("GET /quests/{id}/cycle", s.handleQuestCycle)
+	mux.HandleFunc("GET /users/{id}/cycle", s.handleUserCycle)
+}
+
+//GET /boards/{project}/sections
+//only the explicit mapping, unmapped sections fall back to name guessing
+func (s *server) handleGetSections(w http.ResponseWriter, r *http.Request) {
+	m, err := s.sectionStates(r.PathValue("project"))
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, m)
+}
+
+//PUT /boards/{project}/sections {"To do":"available","Doing":"in_progress"}
+//replaces the board's mapping, takes effect on the next sync
+func (s *server) handlePutSections(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireScope(w, r, scopeAdmin); !ok { return }
+
+	var body map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, "bad json", 400); return }
+	for sec, st := range body {
+		if !slices.Contains(sectionStateChoices, st) {
+			http.Error(w, "section "+sec+": state must be one of "+strings.Join(sectionStateChoices, ", "), 400); return
+		}
+	}
+
+	project := r.PathValue("project")
+	tx, err := s.db.Begin()
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	defer tx.Rollback()
+	if _, err := tx.Exec(`delete from section_states where project_id=$1`, project); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	for sec, st := range body {
+		_, err := tx.Exec(`insert into section_states(project_id, section, state) values($1,$2,$3)`, project, sec, st)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+	}
+	if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, body)
+}
+
+//GET /quests/{id}/cycle
+func (s *server) handleQuestCycle(w http.ResponseWriter, r *http.Request) {
+	var exists bool
+	if err := s.db.QueryRow(`select exists(select 1 from quests where id=$1)`, r.PathValue("id")).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), 500); return
+	}
+	if !exists { http.Error(w, "not found", 404); return }
+	c, err := s.cycleOf(r.PathValue("id"))
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, c)
+}
+
+//GET /users/{id}/cycle
+//cycle times over the quests the user completed, same visibility as the profile
+func (s *server) handleUserCycle(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	viewer := ""
+	if p, err := s.authenticate(r); err == nil && p.can(scopeReadLeaderboard) { viewer = p.userID }
+	var visibility string
+	err := s.db.QueryRow(`select profile_visibility from users where id=$1`, userID).Scan(&visibility)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !canSeeProfile(visibility, userID, viewer)) {
+		http.Error(w, "not found", 404); return
+	}
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	rows, err := s.db.Query(`select id from quests where completed and completed_by=$1`, userID)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil { rows.Close(); http.Error(w, err.Error(), 500); return }
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	var secs []float64
+	for _, id := range ids {
+		c, err := s.cycleOf(id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if c.CycleTimeSeconds != nil { secs = append(secs, *c.CycleTimeSeconds) }
+	}
+	out := map[string]any{"user_id": userID, "quests": len(secs), "mean_seconds": nil, "median_seconds": nil}
+	if len(secs) > 0 {
+		sort.Float64s(secs)
+		sum := 0.0
+		for _, v := range secs { sum += v }
+		out["mean_seconds"] = sum / float64(len(secs))
+		out["median_seconds"] = secs[len(secs)/2]
+		if len(secs)%2 == 0 { out["median_seconds"] = (secs[len(secs)/2-1] + secs[len(secs)/2]) / 2 }
+	}
+	writeJSON(w, out)
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestQuestState(t *testing.T) {
+	mapped := map[string]string{"Ready": stateAvailable, "Parked": stateBacklog, "Later maybe": stateInProgress, "Shipped": stateDone}
+	cases := []struct {
+		section   string
+		completed bool
+		want      string
+	}{
+		{"Ready", false, stateAvailable},
+		{"Parked", false, stateBacklog},
+		//the board's mapping beats the name guess
+		{"Later maybe", false, stateInProgress},
+		{"Ready", true, stateDone},
+		{"Backlog", false, stateBacklog},
+		{"Icebox", false, stateBacklog},
+		{"In Progress", false, stateInProgress},
+		{"Doing", false, stateInProgress},
+		{"WIP", false, stateInProgress},
+		{"Code review", false, stateReview},
+		{"QA", false, stateReview},
+		//done only comes from completing the task
+		{"Done", false, stateAvailable},
+		{"Completed this week", false, stateAvailable},
+		{"Shipped", false, stateAvailable},
+		//whole words only
+		{"Equality fixes", false, stateAvailable},
+		{"Translater", false, stateAvailable},
+		{"Reviewed", false, stateAvailable},
+		{"qa/staging", false, stateReview},
+		{"To do", false, stateAvailable},
+		{"", false, stateAvailable},
+		{"", true, stateDone},
+	}
+	for _, c := range cases {
+		if got := questState(mapped, c.section, c.completed); got != c.want {
+			t.Errorf("questState(%q, %v) = %q, want %q", c.section, c.completed, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func ensureSlackTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS slack_users (
+		  slack_user_id TEXT PRIMARY KEY,
+		  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE
+		);
+
+		CREATE TABLE IF NOT EXISTS slack_link_tokens (
+		  token TEXT PRIMARY KEY,
+		  slack_user_id TEXT NOT NULL,
+		  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+
+		ALTER TABLE slack_link_tokens ADD COLUMN IF NOT EXISTS slack_user_name TEXT NOT NULL DEFAULT '';
+	`)
+	return err
+}
+
+func ensureSlackTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS slack_users (
+		  slack_user_id TEXT PRIMARY KEY,
+		  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE
+		);
+
+		CREATE TABLE IF NOT EXISTS slack_link_tokens (
+		  token TEXT PRIMARY KEY,
+		  slack_user_id TEXT NOT NULL,
+		  created_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`
+		);
+	`)
+	if err != nil { return err }
+	return addColumnSQLite(db, "slack_link_tokens", "slack_user_name", "TEXT NOT NULL DEFAULT ''")
+}
+
+func (s *server) mountSlack(mux *http.ServeMux) {
+	mux.HandleFunc("POST /integrations/slack/command", s.handleSlackCommand)
+	mux.HandleFunc("GET /integrations/slack/link", s.handleSlackLinkConfirm)
+	mux.HandleFunc("POST /integrations/slack/link", s.handleSlackLink)
+}
+
+//escaped user mentions look like <@U024BE7LH|bob>
+var slackMention = regexp.MustCompile(`^<@([A-Z0-9]+)(?:\|[^>]*)?>$`)
+
+//checks X-Slack-Signature, see https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackSignature(secret string, h http.Header, body []byte) error {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil { return errors.New("bad timestamp") }
+	if d := time.Since(time.Unix(sec, 0)); d > 5*time.Minute || d < -5*time.Minute {
+		return errors.New("stale request")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(h.Get("X-Slack-Signature"))) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+//POST /integrations/slack/command
+//handles /quest board | me | rank @user | kudos @user msg | link
+func (s *server) handleSlackCommand(w http.ResponseWriter, r *http.Request) {
+	secret := s.cfg.SlackSigningSecret
+	if secret == "" { http.Error(w, "slack not configured", 500); return }
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil { http.Error(w, "bad body", 400); return }
+	if err := verifySlackSignature(secret, r.Header, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized); return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil { http.Error(w, "bad form", 400); return }
+
+	slackUser := form.Get("user_id")
+	args := strings.Fields(form.Get("text"))
+	sub := "board"
+	if len(args) > 0 { sub = strings.ToLower(args[0]); args = args[1:] }
+
+	var text string
+	inChannel := false
+	switch sub {
+	case "board":
+		text, err = s.slackBoard(slackUser)
+		inChannel = true
+	case "me":
+		text, err = s.slackRank(slackUser, slackUser, "You")
+	case "rank":
+		if len(args) == 0 { text = "usage: /quest rank @user"; break }
+		m := slackMention.FindStringSubmatch(args[0])
+		if m == nil { text = "mention someone, like /quest rank @user"; break }
+		text, err = s.slackRank(slackUser, m[1], args[0])
+	case "kudos":
+		if len(args) < 2 { text = "usage: /quest kudos @user message"; break }
+		m := slackMention.FindStringSubmatch(args[0])
+		if m == nil { text = "mention someone, like /quest kudos @user thanks!"; break }
+		text, err = s.slackKudos(slackUser, m[1], args[0], strings.Join(args[1:], " "))
+		inChannel = err == nil
+	case "link":
+		text, err = s.slackLinkStart(slackUser, form.Get("user_name"))
+	default:
+		text = "commands: board, me, rank @user, kudos @user msg, link"
+	}
+	if err != nil { text = "something went wrong: " + err.Error(); inChannel = false }
+
+	resp := map[string]string{"response_type": "ephemeral", "text": text}
+	if inChannel { resp["response_type"] = "in_channel" }
+	writeJSON(w, resp)
+}
+
+//the all-time top 10 as the caller would see it, only public profiles until they link
+func (s *server) slackBoard(slackUser string) (string, error) {
+	viewer, err := s.slackLinkedUser(slackUser)
+	if err != nil { return "", err }
+	rows, err := s.leaderboardPage(boardQuery{window: "all", viewer: viewer}, 10, 0)
+	if err != nil { return "", err }
+	if len(rows) == 0 { return "nobody is on the board yet", nil }
+	var b strings.Builder
+	b.WriteString("*Quest board*\n")
+	for _, row := range rows {
+		fmt.Fprintf(&b, "%d. %s — %g pts\n", row.Rank, slackEscape(row.Name), row.Points)
+	}
+	return b.String(), nil
+}
+
+//viewerSlack asked about slackUser, private profiles only answer their owner
+func (s *server) slackRank(viewerSlack, slackUser, label string) (string, error) {
+	userID, err := s.slackLinkedUser(slackUser)
+	if err != nil { return "", err }
+	if userID == "" { return label + " hasn't linked Asana yet, run /quest link", nil }
+	viewer, err := s.slackLinkedUser(viewerSlack)
+	if err != nil { return "", err }
+	var visibility string
+	if err := s.db.QueryRow(`select profile_visibility from users where id=$1`, userID).Scan(&visibility); err != nil { return "", err }
+	if !canSeeProfile(visibility, userID, viewer) { return label + " keeps their rank private", nil }
+	row, rank, err := s.userStanding(userID)
+	if err != nil { return "", err }
+	return fmt.Sprintf("%s (%s) is #%d with %g pts", label, slackEscape(row.Name), rank, row.Points), nil
+}
+
+func (s *server) slackKudos(fromSlack, toSlack, label, msg string) (string, error) {
+	from, err := s.slackLinkedUser(fromSlack)
+	if err != nil { return "", err }
+	if from == "" { return "link your Asana account first with /quest link", nil }
+	to, err := s.slackLinkedUser(toSlack)
+	if err != nil { return "", err }
+	if to == "" { return label + " hasn't linked Asana yet", nil }
+	if err := s.giveKudos(from, to, msg, "slack"); err != nil {
+		if errors.Is(err, errSelfKudos) { return "nice try", nil }
+		return "", err
+	}
+	return fmt.Sprintf("<@%s> gave kudos to %s: %s", fromSlack, label, slackEscape(msg)), nil
+}
+
+//slack reads <...> as mentions and links, so text people typed or named in
+//asana is escaped before we post it, otherwise "<!channel>" pings everyone
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+//empty user id when the slack user isn't mapped yet
+func (s *server) slackLinkedUser(slackUser string) (string, error) {
+	var userID string
+	err := s.db.QueryRow(`select user_id from slack_users where slack_user_id=$1`, slackUser).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) { return "", nil }
+	return userID, err
+}
+
+//hands out a one-time link, opening it while logged into the board asks to map the slack user
+func (s *server) slackLinkStart(slackUser, slackName string) (string, error) {
+	token := randomString(24)
+	_, err := s.db.Exec(`insert into slack_link_tokens(token, slack_user_id, slack_user_name) values($1,$2,$3)`,
+		token, slackUser, slackName)
+	if err != nil { return "", err }
+	u := s.cfg.PublicAPIURL + "/integrations/slack/link?token=" + url.QueryEscape(token)
+	return "open this while logged into the quest board to link your account: " + u, nil
+}
+
+//links are good for 15 minutes
+func slackLinkCutoff() time.Time { return time.Now().Add(-15 * time.Minute) }
+
+var slackLinkPage = template.Must(template.New("link").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>Link Slack</title></head>
+<body>
+<p>Link the Slack user <strong>@{{.SlackName}}</strong> ({{.SlackUser}}) to your quest board account <strong>{{.Name}}</strong>?</p>
+<p>Only continue if you ran <code>/quest link</code> yourself.</p>
+<form method="post" action="link">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Link accounts</button>
+</form>
+</body></html>
+`))
+
+//GET /integrations/slack/link?token=
+//only shows who is about to be linked, the link itself is the POST below so a
+//stray GET (a prefetch, an image tag on another site) can't map anyone
+func (s *server) handleSlackLinkConfirm(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionUserID(r)
+	if err != nil { http.Error(w, "log in to the quest board first", http.StatusUnauthorized); return }
+
+	token := r.URL.Query().Get("token")
+	page := struct{ SlackUser, SlackName, Name, Token string }{Token: token}
+	err = s.db.QueryRow(`select slack_user_id, slack_user_name from slack_link_tokens
+		where token=$1 and created_at > $2`, token, slackLinkCutoff()).Scan(&page.SlackUser, &page.SlackName)
+	if err != nil { http.Error(w, "link expired", 400); return }
+	if page.SlackName == "" { page.SlackName = page.SlackUser }
+	u, err := s.users.GetUser(r.Context(), userID)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	page.Name = u.Name
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	slackLinkPage.Execute(w, page)
+}
+
+//POST /integrations/slack/link token=
+//sent by the confirmation page, goes through csrfProtect like every other POST
+func (s *server) handleSlackLink(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionUserID(r)
+	if err != nil { http.Error(w, "log in to the quest board first", http.StatusUnauthorized); return }
+
+	var slackUser string
+	err = s.db.QueryRow(`delete from slack_link_tokens
+		where token=$1 and created_at > $2
+		returning slack_user_id`, r.PostFormValue("token"), slackLinkCutoff()).Scan(&slackUser)
+	if err != nil { http.Error(w, "link expired", 400); return }
+
+	_, err = s.db.Exec(`insert into slack_users(slack_user_id, user_id) values($1,$2)
+		on conflict (slack_user_id) do update set user_id=excluded.user_id`, slackUser, userID)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	http.Redirect(w, r, s.cfg.PostLoginRedirect, http.StatusSeeOther)
+}
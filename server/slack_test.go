@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func slackSign(secret, ts, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":" + body))
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-6*time.Minute).Unix(), 10)
+	ahead := strconv.FormatInt(time.Now().Add(6*time.Minute).Unix(), 10)
+	recent := strconv.FormatInt(time.Now().Add(-4*time.Minute).Unix(), 10)
+	body := "command=%2Fquest&text=board"
+	cases := []struct {
+		name, ts, sig, body string
+		ok                  bool
+	}{
+		{"valid", now, slackSign("shh", now, body), body, true},
+		{"four minutes old", recent, slackSign("shh", recent, body), body, true},
+		{"tampered body", now, slackSign("shh", now, body), body + "&x=1", false},
+		{"other secret", now, slackSign("nope", now, body), body, false},
+		{"stale", stale, slackSign("shh", stale, body), body, false},
+		{"from the future", ahead, slackSign("shh", ahead, body), body, false},
+		{"bad timestamp", "soon", slackSign("shh", "soon", body), body, false},
+		{"no signature", now, "", body, false},
+	}
+	for _, c := range cases {
+		h := http.Header{}
+		h.Set("X-Slack-Request-Timestamp", c.ts)
+		h.Set("X-Slack-Signature", c.sig)
+		err := verifySlackSignature("shh", h, []byte(c.body))
+		if (err == nil) != c.ok { t.Errorf("%s: err = %v, want ok %v", c.name, err, c.ok) }
+	}
+}
+
+func TestSlackLinkConfirm(t *testing.T) {
+	s := newSQLiteTestServer(t)
+	if _, err := s.db.Exec(`insert into users(id, name) values('U1','Ada')`); err != nil { t.Fatal(err) }
+	mux := http.NewServeMux()
+	s.mountSlack(mux)
+	h := csrfProtect(newCORSPolicy(nil, 0), s.sessionCookieName(), mux)
+
+	text, err := s.slackLinkStart("S1", "bob")
+	if err != nil { t.Fatal(err) }
+	link, err := url.Parse(text[strings.Index(text, "http"):])
+	if err != nil { t.Fatal(err) }
+	token := link.Query().Get("token")
+	linked := func() bool {
+		var n int
+		if err := s.db.QueryRow(`select count(*) from slack_users where slack_user_id='S1'`).Scan(&n); err != nil { t.Fatal(err) }
+		return n > 0
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/integrations/slack/link?token="+token, nil))
+	if rec.Code != 401 { t.Errorf("anonymous get: %d", rec.Code) }
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, signedIn(t, s, httptest.NewRequest("GET", "/integrations/slack/link?token="+token, nil), "U1"))
+	if body := rec.Body.String(); rec.Code != 200 || !strings.Contains(body, "@bob") || !strings.Contains(body, "Ada") || !strings.Contains(body, `value="`+token+`"`) {
+		t.Errorf("confirm page: %d %s", rec.Code, body)
+	}
+	if linked() { t.Fatal("the confirmation page linked the account") }
+
+	post := func(origin string) int {
+		r := httptest.NewRequest("POST", "http://quests.example/integrations/slack/link", strings.NewReader("token="+token))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, signedIn(t, s, r, "U1"))
+		return rec.Code
+	}
+	if code := post("https://evil.example"); code != 403 || linked() { t.Errorf("cross-site post: %d, linked %v", code, linked()) }
+	if code := post("http://quests.example"); code != 303 || !linked() { t.Errorf("post: %d, linked %v", code, linked()) }
+	if code := post("http://quests.example"); code != 400 { t.Errorf("reused token: %d", code) }
+}
+
+func TestSlackEscape(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"thanks for the review", "thanks for the review"},
+		{"<!channel> look", "&lt;!channel&gt; look"},
+		{"<https://evil.example|docs>", "&lt;https://evil.example|docs&gt;"},
+		{"salt & pepper", "salt &amp; pepper"},
+		{"&lt;", "&amp;lt;"},
+	}
+	for _, c := range cases {
+		if got := slackEscape(c.in); got != c.want { t.Errorf("slackEscape(%q) = %q, want %q", c.in, got, c.want) }
+	}
+}
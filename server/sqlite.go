@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+//DATABASE_URL=sqlite:///var/lib/questboard.db (or sqlite:questboard.db) runs
+//on a local file through a pure go driver, no cgo and no postgres needed.
+//every migration step has a sqlite twin next to it, queries stick to sql both
+//understand and take times as arguments instead of calling now()
+
+//the file path when dsn names a sqlite database
+func sqlitePath(dsn string) (string, bool) {
+	if p, ok := strings.CutPrefix(dsn, "sqlite://"); ok { return p, true }
+	return strings.CutPrefix(dsn, "sqlite:")
+}
+
+func (c config) sqlite() bool {
+	_, ok := sqlitePath(c.DatabaseURL)
+	return ok
+}
+
+//column default for TIMESTAMP columns, in the unix millis the driver writes
+const sqliteNow = "(CAST(unixepoch('subsec') * 1000 AS INTEGER))"
+
+func openSQLite(path string) (*sql.DB, error) {
+	//wal lets readers run next to the writer, busy_timeout waits out the
+	//writer instead of failing with SQLITE_BUSY. times are stored as unix
+	//millis so they compare as numbers, and transactions take the write lock
+	//up front, which stands in for postgres' select ... for update
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)" +
+		"&_time_integer_format=unix_milli&_inttotime=1&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil { return nil, err }
+	if err := db.Ping(); err != nil { return nil, err }
+	return db, nil
+}
+
+//sqlite has no ADD COLUMN IF NOT EXISTS, so look before adding
+func addColumnSQLite(db *sql.DB, table, column, decl string) error {
+	var n int
+	err := db.QueryRow(`select count(*) from pragma_table_info($1) where name=$2`, table, column).Scan(&n)
+	if err != nil || n > 0 { return err }
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+	return err
+}
+
+//appended to selects that lock rows inside a transaction. sqlite has no
+//FOR UPDATE, its transactions already hold the write lock
+func (c config) forUpdate() string {
+	if c.sqlite() { return "" }
+	return " for update"
+}
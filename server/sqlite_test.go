@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//a migrated server on a fresh sqlite file
+func newSQLiteTestServer(t *testing.T) *server {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.DatabaseURL = "sqlite:" + t.TempDir() + "/quests.db"
+	path, _ := sqlitePath(cfg.DatabaseURL)
+	db, err := openSQLite(path)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db, cfg.migrations()); err != nil { t.Fatal(err) }
+	//twice, the steps have to be safe to rerun
+	if err := migrate(db, cfg.migrations()); err != nil { t.Fatal(err) }
+	return newServer(db, cfg, newSQLStore(db))
+}
+
+//answers the project task list and task updates the way asana does, for
+//everything asanaHTTP sends while the test runs
+type fakeAsana struct {
+	mu    sync.Mutex
+	tasks map[string]*asanaTask
+	order []string
+	//tasks PUTs get a 403 for, and a hook run before a PUT is applied
+	forbid map[string]bool
+	onPUT  func(taskID string)
+	puts   int
+	//webhook gid to active, and the handshake asana sends before answering the POST
+	hooks     map[string]bool
+	handshake func(target string)
+}
+
+func newFakeAsana(t *testing.T, tasks ...asanaTask) *fakeAsana {
+	f := &fakeAsana{tasks: map[string]*asanaTask{}, forbid: map[string]bool{}, hooks: map[string]bool{}}
+	for i := range tasks {
+		f.tasks[tasks[i].Gid] = &tasks[i]
+		f.order = append(f.order, tasks[i].Gid)
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	to, _ := url.Parse(srv.URL)
+	old := asanaHTTP
+	asanaHTTP = &http.Client{Transport: rewriteHost{to: to}}
+	t.Cleanup(func() { asanaHTTP = old })
+	return f
+}
+
+func (f *fakeAsana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/1.0")
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(path, "/tasks"):
+		var out []asanaTask
+		for _, id := range f.order { out = append(out, *f.tasks[id]) }
+		writeJSON(w, map[string]any{"data": out})
+	case r.Method == "PUT" && strings.HasPrefix(path, "/tasks/"):
+		id := strings.TrimPrefix(path, "/tasks/")
+		task := f.tasks[id]
+		if task == nil { http.NotFound(w, r); return }
+		f.puts++
+		if f.forbid[id] { http.Error(w, `{"errors":[{"message":"forbidden"}]}`, 403); return }
+		if f.onPUT != nil { f.onPUT(id) }
+		var body struct{ Data map[string]any `json:"data"` }
+		json.NewDecoder(r.Body).Decode(&body)
+		if done, ok := body.Data["completed"].(bool); ok {
+			now := time.Now()
+			task.Completed, task.CompletedAt = done, &now
+		}
+		if a, ok := body.Data["assignee"]; ok {
+			task.Assignee = nil
+			if id, _ := a.(string); id != "" { task.Assignee = testTask("", "", "", id).Assignee }
+		}
+		writeJSON(w, map[string]any{"data": task})
+	case r.Method == "POST" && path == "/webhooks":
+		var body struct{ Data struct{ Target string `json:"target"` } `json:"data"` }
+		json.NewDecoder(r.Body).Decode(&body)
+		if f.handshake != nil { f.handshake(body.Data.Target) }
+		gid := "W" + strconv.Itoa(len(f.hooks)+1)
+		f.hooks[gid] = true
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]any{"data": map[string]any{"gid": gid, "active": true}})
+	case strings.HasPrefix(path, "/webhooks/"):
+		gid := strings.TrimPrefix(path, "/webhooks/")
+		active, ok := f.hooks[gid]
+		if !ok { http.NotFound(w, r); return }
+		if r.Method == "DELETE" { delete(f.hooks, gid); active = false }
+		writeJSON(w, map[string]any{"data": map[string]any{"gid": gid, "active": active}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type rewriteHost struct{ to *url.URL }
+
+func (rh rewriteHost) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = rh.to.Scheme, rh.to.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func testTask(gid, name, difficulty, assignee string) asanaTask {
+	t := asanaTask{Gid: gid, Name: name, CustomFields: []map[string]any{{"name": "Difficulty", "display_value": difficulty}}}
+	if assignee != "" {
+		t.Assignee = &struct {
+			Gid   string `json:"gid"`
+			Name  string `json:"name"`
+			Photo *struct{ Image128 string `json:"image_128x128"` } `json:"photo"`
+		}{Gid: assignee, Name: "user " + assignee}
+	}
+	return t
+}
+
+func countActivity(t *testing.T, s *server, kind, userID string) int {
+	t.Helper()
+	var n int
+	err := s.db.QueryRow(`select count(*) from activity where kind=$1 and user_id=$2`, kind, userID).Scan(&n)
+	if err != nil { t.Fatal(err) }
+	return n
+}
+
+func pointsOf(t *testing.T, s *server, userID string) float64 {
+	t.Helper()
+	var p float64
+	err := s.db.QueryRow(`select coalesce((select points from scores where user_id=$1), 0)`, userID).Scan(&p)
+	if err != nil { t.Fatal(err) }
+	return p
+}
+
+//sync, claim, complete, bounties, boards, exports and health on sqlite
+func TestSQLiteQuestFlow(t *testing.T) {
+	s := newSQLiteTestServer(t)
+	ctx := context.Background()
+	done := testTask("T1", "fix the build", "hard", "U1")
+	doneAt := time.Now().Add(-time.Minute)
+	done.Completed, done.CompletedAt = true, &doneAt
+	open := testTask("T2", "write docs", "medium", "")
+	asana := newFakeAsana(t, done, open, testTask("T3", "triage", "easy", "U2"))
+	service := &asanaTokens{AccessToken: "pat", Scope: "default"}
+
+	completers, err := s.syncProject(ctx, service, "P1")
+	if err != nil { t.Fatal(err) }
+	if len(completers) != 1 || completers[0] != "U1" { t.Fatalf("completers = %v, want [U1]", completers) }
+	if err := s.rescoreUser("U1"); err != nil { t.Fatal(err) }
+	if got := pointsOf(t, s, "U1"); got != 3 { t.Errorf("U1 points = %v, want 3", got) }
+
+	//a second sync finds nothing new to pay
+	completers, err = s.syncProject(ctx, service, "P1")
+	if err != nil { t.Fatal(err) }
+	if len(completers) != 0 { t.Errorf("second sync completers = %v", completers) }
+	if n := countActivity(t, s, activityQuestCompleted, "U1"); n != 1 { t.Errorf("U1 completions = %d, want 1", n) }
+
+	_, err = s.db.Exec(`insert into bounties(quest_id, points, first_only, created_at) values('T2', 5, true, $1)`, time.Now())
+	if err != nil { t.Fatal(err) }
+	bo := &asanaTokens{AccessToken: "bo", Scope: "default", UserID: "U2"}
+	if _, err := s.claimQuest(ctx, bo, "T2"); err != nil { t.Fatal(err) }
+	asana.mu.Lock()
+	asana.tasks["T2"].Assignee = testTask("", "", "", "U2").Assignee
+	asana.mu.Unlock()
+	if _, err := s.completeQuest(ctx, bo, "T2"); err != nil { t.Fatal(err) }
+	//a retry pays nothing twice
+	if _, err := s.completeQuest(ctx, bo, "T2"); err != nil { t.Fatal(err) }
+	if got := pointsOf(t, s, "U2"); got != 7 { t.Errorf("U2 points = %v, want 2 + 5 bounty", got) }
+	if n := countActivity(t, s, activityBounty, "U2"); n != 1 { t.Errorf("U2 bounties = %d, want 1", n) }
+	var claims int
+	if err := s.db.QueryRow(`select count(*) from quest_claims`).Scan(&claims); err != nil { t.Fatal(err) }
+	if claims != 0 { t.Errorf("%d claims left after completion", claims) }
+
+	//sync sees the board completion and leaves the ledger alone
+	if _, err := s.syncProject(ctx, service, "P1"); err != nil { t.Fatal(err) }
+	if n := countActivity(t, s, activityQuestCompleted, "U2"); n != 1 { t.Errorf("U2 completions = %d, want 1", n) }
+
+	for _, window := range []string{"all", "week", "month", "season"} {
+		r := httptest.NewRequest("GET", "/leaderboard?window="+window, nil)
+		bq, err := s.parseBoardQuery(r)
+		if err != nil { t.Fatal(err) }
+		board, err := s.leaderboardPage(bq, 10, 0)
+		if err != nil { t.Fatalf("%s: %v", window, err) }
+		//T1 was done before the test opened the first season
+		want := 3.0
+		if window == "season" { want = 0 }
+		if len(board) < 2 || board[0].UserID != "U2" || board[0].Points != 7 || board[1].Points != want {
+			t.Errorf("%s board = %+v", window, board)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleActivity(rec, httptest.NewRequest("GET", "/activity?kind=bounty&limit=5", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"quest_name":"write docs"`) {
+		t.Errorf("activity: %d %s", rec.Code, rec.Body)
+	}
+
+	var buf bytes.Buffer
+	from := time.Now().Add(-24 * time.Hour)
+	board := "P1"
+	if err := s.exportLedgerNDJSON(&buf, exportFilter{from: &from, board: &board}); err != nil { t.Fatal(err) }
+	if n := strings.Count(buf.String(), "\n"); n != 3 { t.Errorf("ledger has %d lines, want 3:\n%s", n, buf.String()) }
+	buf.Reset()
+	if err := s.exportQuestsCSV(&buf, exportFilter{}); err != nil { t.Fatal(err) }
+	if !strings.Contains(buf.String(), "T1,fix the build,hard,true,U1") { t.Errorf("quests.csv:\n%s", buf.String()) }
+
+	if streak, err := s.streakOf("U1"); err != nil || streak != 1 { t.Errorf("U1 streak = %d, %v", streak, err) }
+	if c := s.checkSync(ctx); c.Status != "ok" { t.Errorf("sync check = %+v", c) }
+	if c := s.checkMigrations(ctx); c.Status != "ok" { t.Errorf("migrations check = %+v", c) }
+	if err := s.expireClaims(ctx); err != nil { t.Fatal(err) }
+
+	var out bytes.Buffer
+	if err := s.recomputeAll(recomputeOpts{source: "ledger", batch: 1}, &out); err != nil { t.Fatal(err) }
+	if got := pointsOf(t, s, "U2"); got != 7 { t.Errorf("U2 points after recompute = %v", got) }
+}
+
+//keeps every event it is sent
+type recordSink struct {
+	mu  sync.Mutex
+	got []notifyEvent
+}
+
+func (r *recordSink) name() string { return "record" }
+
+func (r *recordSink) send(ctx context.Context, ev notifyEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.got = append(r.got, ev)
+	return nil
+}
+
+func TestSyncBackfill(t *testing.T) {
+	s := newSQLiteTestServer(t)
+	sink := &recordSink{}
+	s.notifier = &notifier{db: s.db, jobs: s.jobs, sinks: map[string]notifySink{"record": sink}, rules: defaultNotifyRules(), retries: 1}
+	for i := range s.notifier.rules { s.notifier.rules[i].sinks = []string{"record"} }
+
+	old := testTask("T1", "old news", "hard", "U1")
+	oldAt := time.Now().Add(-72 * time.Hour).Truncate(time.Millisecond)
+	old.Completed, old.CompletedAt = true, &oldAt
+	fresh := testTask("T2", "just now", "hard", "U1")
+	freshAt := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	fresh.Completed, fresh.CompletedAt = true, &freshAt
+	newFakeAsana(t, old, fresh)
+
+	if _, err := s.syncProject(context.Background(), &asanaTokens{AccessToken: "pat", Scope: "default"}, "P1"); err != nil { t.Fatal(err) }
+	if err := s.jobs.Wait(context.Background()); err != nil { t.Fatal(err) }
+
+	for id, want := range map[string]time.Time{"T1": oldAt, "T2": freshAt} {
+		var at time.Time
+		err := s.db.QueryRow(`select created_at from activity where kind=$1 and quest_id=$2`, activityQuestCompleted, id).Scan(&at)
+		if err != nil { t.Fatal(err) }
+		if !at.Equal(want) { t.Errorf("%s dated %v, want %v", id, at, want) }
+	}
+	if len(sink.got) != 1 || sink.got[0].Data["quest_name"] != "just now" { t.Errorf("notified %+v, want only T2", sink.got) }
+}
+
+func TestClaimRaceAndExpiry(t *testing.T) {
+	s := newSQLiteTestServer(t)
+	s.cfg.AsanaPAT, s.cfg.ClaimExpiry = "pat", time.Hour
+	ctx := context.Background()
+	for _, id := range []string{"U1", "U2"} {
+		if _, err := s.db.Exec(`insert into users(id, name) values($1,$1)`, id); err != nil { t.Fatal(err) }
+	}
+	asana := newFakeAsana(t, testTask("T1", "raced", "easy", ""), testTask("T2", "idle", "easy", ""), testTask("T3", "locked", "easy", ""))
+	if _, err := s.syncProject(ctx, &asanaTokens{AccessToken: "pat", Scope: "default"}, "P1"); err != nil { t.Fatal(err) }
+	u1 := &asanaTokens{AccessToken: "u1", Scope: "default", UserID: "U1"}
+
+	//U2 takes T1 on the board while U1's asana call is in flight
+	asana.onPUT = func(string) {
+		asana.onPUT = nil
+		if _, err := s.db.Exec(`update quests set assignee_id='U2' where id='T1'`); err != nil { t.Error(err) }
+	}
+	if _, err := s.claimQuest(ctx, u1, "T1"); !errors.Is(err, errQuestTaken) { t.Fatalf("raced claim err = %v", err) }
+	if a := asana.tasks["T1"].Assignee; a == nil || a.Gid != "U2" { t.Errorf("asana T1 assignee = %+v, want U2 back", a) }
+
+	for _, id := range []string{"T2", "T3"} {
+		if _, err := s.claimQuest(ctx, u1, id); err != nil { t.Fatal(err) }
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if _, err := s.db.Exec(`update quest_claims set claimed_at=$1`, old); err != nil { t.Fatal(err) }
+	if _, err := s.db.Exec(`update quest_transitions set at=$1`, old); err != nil { t.Fatal(err) }
+	//recent work on T2 keeps the claim alive
+	if err := s.recordActivity(activityKudos, "U1", "T2", 0, nil); err != nil { t.Fatal(err) }
+	asana.forbid["T3"] = true
+
+	claimed := func(id string) (bool, *string) {
+		var errText *string
+		err := s.db.QueryRow(`select expire_error from quest_claims where quest_id=$1`, id).Scan(&errText)
+		if errors.Is(err, sql.ErrNoRows) { return false, nil }
+		if err != nil { t.Fatal(err) }
+		return true, errText
+	}
+	if err := s.expireClaims(ctx); err != nil { t.Fatal(err) }
+	if ok, _ := claimed("T2"); !ok { t.Error("T2 released despite recent activity") }
+	ok, errText := claimed("T3")
+	if !ok || errText == nil { t.Fatalf("T3 claim = %v %v, want parked", ok, errText) }
+
+	puts := asana.puts
+	if _, err := s.db.Exec(`update activity set created_at=$1`, old); err != nil { t.Fatal(err) }
+	if err := s.expireClaims(ctx); err != nil { t.Fatal(err) }
+	if ok, _ := claimed("T2"); ok { t.Error("idle T2 claim kept") }
+	if asana.puts != puts+1 { t.Errorf("%d asana calls, want 1 for T2 and none for the parked T3", asana.puts-puts) }
+}
+
+func TestCompleteRace(t *testing.T) {
+	s := newSQLiteTestServer(t)
+	ctx := context.Background()
+	asana := newFakeAsana(t, testTask("T1", "raced", "easy", "U1"))
+	if _, err := s.syncProject(ctx, &asanaTokens{AccessToken: "pat", Scope: "default"}, "P1"); err != nil { t.Fatal(err) }
+	if _, err := s.db.Exec(`insert into users(id, name) values('U2','U2')`); err != nil { t.Fatal(err) }
+
+	//a sync hands T1 to U2 while U1's completion is in flight
+	asana.onPUT = func(string) {
+		asana.onPUT = nil
+		if _, err := s.db.Exec(`update quests set assignee_id='U2' where id='T1'`); err != nil { t.Error(err) }
+	}
+	u1 := &asanaTokens{AccessToken: "u1", Scope: "default", UserID: "U1"}
+	if _, err := s.completeQuest(ctx, u1, "T1"); !errors.Is(err, errNotClaimer) { t.Fatalf("raced complete err = %v", err) }
+	if asana.tasks["T1"].Completed { t.Error("asana T1 left completed") }
+	if n := countActivity(t, s, activityQuestCompleted, "U1"); n != 0 { t.Errorf("U1 paid %d times", n) }
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+//the storage behind logins and quests. postgres or sqlite in production,
+//memory for handler tests. everything else, scores and the ledger they come
+//from included, goes through s.db
+
+//lookups that find nothing return errNotFound, whatever the backend
+var errNotFound = errors.New("not found")
+
+type userRow struct {
+	ID        string
+	Name      string
+	AvatarURL *string
+}
+
+//every store at once, newServer takes one of these
+type store interface {
+	UserStore
+	SessionStore
+	QuestStore
+}
+
+type UserStore interface {
+	//insert or rename, an empty AvatarURL keeps the one on file
+	UpsertUser(ctx context.Context, u userRow) error
+	GetUser(ctx context.Context, id string) (*userRow, error)
+	//the asana oauth login stored for t.UserID, inserted or replaced
+	SaveAsanaTokens(ctx context.Context, t *asanaTokens) error
+	AsanaTokens(ctx context.Context, userID string) (*asanaTokens, error)
+}
+
+type SessionStore interface {
+	//oauth state and pkce verifier kept between start and callback
+	SavePending(ctx context.Context, sid, state, verifier string) error
+	Pending(ctx context.Context, sid string) (state, verifier string, err error)
+	ClearPending(ctx context.Context, sid string) error
+
+	CreateSession(ctx context.Context, sid, userID string) error
+	SessionUser(ctx context.Context, sid string) (string, error)
+	DeleteSession(ctx context.Context, sid string) error
+}
+
+type QuestStore interface {
+	//open quests first, then by name
+	ListQuests(ctx context.Context, limit int) ([]quest, error)
+	GetQuest(ctx context.Context, id string) (*quest, error)
+}
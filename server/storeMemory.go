@@ -0,0 +1,142 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+)
+
+//every store in maps, for handler tests with httptest. nothing survives a restart
+type memStore struct {
+	mu       sync.Mutex
+	users    map[string]userRow
+	tokens   map[string]asanaTokens
+	pending  map[string][2]string
+	sessions map[string]string
+	quests   map[string]quest
+}
+
+var (
+	_ UserStore    = (*memStore)(nil)
+	_ SessionStore = (*memStore)(nil)
+	_ QuestStore   = (*memStore)(nil)
+)
+
+func newMemStore() *memStore {
+	return &memStore{
+		users:    map[string]userRow{},
+		tokens:   map[string]asanaTokens{},
+		pending:  map[string][2]string{},
+		sessions: map[string]string{},
+		quests:   map[string]quest{},
+	}
+}
+
+//quests normally arrive through sync, tests seed them here
+func (m *memStore) putQuest(q quest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quests[q.ID] = q
+}
+
+func (m *memStore) UpsertUser(ctx context.Context, u userRow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.users[u.ID]; ok && (u.AvatarURL == nil || *u.AvatarURL == "") {
+		u.AvatarURL = old.AvatarURL
+	}
+	m.users[u.ID] = u
+	return nil
+}
+
+func (m *memStore) GetUser(ctx context.Context, id string) (*userRow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok { return nil, errNotFound }
+	return &u, nil
+}
+
+func (m *memStore) SaveAsanaTokens(ctx context.Context, t *asanaTokens) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[t.UserID] = *t
+	return nil
+}
+
+func (m *memStore) AsanaTokens(ctx context.Context, userID string) (*asanaTokens, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[userID]
+	if !ok { return nil, errNotFound }
+	return &t, nil
+}
+
+func (m *memStore) SavePending(ctx context.Context, sid, state, verifier string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[sid] = [2]string{state, verifier}
+	return nil
+}
+
+func (m *memStore) Pending(ctx context.Context, sid string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pending[sid]
+	if !ok { return "", "", errNotFound }
+	return p[0], p[1], nil
+}
+
+func (m *memStore) ClearPending(ctx context.Context, sid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, sid)
+	return nil
+}
+
+func (m *memStore) CreateSession(ctx context.Context, sid, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[sid] = userID
+	return nil
+}
+
+func (m *memStore) SessionUser(ctx context.Context, sid string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	uid, ok := m.sessions[sid]
+	if !ok { return "", errNotFound }
+	return uid, nil
+}
+
+func (m *memStore) DeleteSession(ctx context.Context, sid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, sid)
+	return nil
+}
+
+func (m *memStore) ListQuests(ctx context.Context, limit int) ([]quest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []quest
+	for _, q := range m.quests { out = append(out, q) }
+	slices.SortFunc(out, func(a, b quest) int {
+		if a.Completed != b.Completed {
+			if a.Completed { return 1 }
+			return -1
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	if len(out) > limit { out = out[:limit] }
+	return out, nil
+}
+
+func (m *memStore) GetQuest(ctx context.Context, id string) (*quest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.quests[id]
+	if !ok { return nil, errNotFound }
+	return &q, nil
+}
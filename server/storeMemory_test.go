@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//the full handler over a memStore, no database behind it
+func newMemTestServer(t *testing.T) (http.Handler, *server, *memStore) {
+	t.Helper()
+	m := newMemStore()
+	s := newServer(nil, defaultConfig(), m)
+	ctx := context.Background()
+	if err := m.UpsertUser(ctx, userRow{ID: "U1", Name: "Ada"}); err != nil { t.Fatal(err) }
+	if err := m.CreateSession(ctx, "sid-U1", "U1"); err != nil { t.Fatal(err) }
+	return s.handler(), s, m
+}
+
+func withSession(s *server, r *http.Request, sid string) *http.Request {
+	if sid != "" { r.AddCookie(&http.Cookie{Name: s.sessionCookieName(), Value: sid}) }
+	return r
+}
+
+func TestMeHandler(t *testing.T) {
+	h, s, _ := newMemTestServer(t)
+	cases := []struct {
+		name, sid string
+		code      int
+	}{
+		{"no cookie", "", 401},
+		{"unknown session", "sid-nobody", 401},
+		{"signed in", "sid-U1", 200},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, withSession(s, httptest.NewRequest("GET", "/api/me", nil), c.sid))
+		if rec.Code != c.code { t.Errorf("%s: code %d, want %d", c.name, rec.Code, c.code); continue }
+		if c.code != 200 { continue }
+		var me map[string]string
+		if err := json.NewDecoder(rec.Body).Decode(&me); err != nil { t.Fatal(err) }
+		if me["user_id"] != "U1" || me["name"] != "Ada" { t.Errorf("%s: me = %v", c.name, me) }
+	}
+}
+
+func TestQuestsHandler(t *testing.T) {
+	h, _, m := newMemTestServer(t)
+	by := "U1"
+	m.putQuest(quest{ID: "T1", Name: "write docs", Difficulty: "easy"})
+	m.putQuest(quest{ID: "T2", Name: "fix the build", Difficulty: "hard", Completed: true, CompletedBy: &by})
+	m.putQuest(quest{ID: "T3", Name: "add tests", Difficulty: "medium"})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/quests", nil))
+	if rec.Code != 200 { t.Fatalf("code %d: %s", rec.Code, rec.Body) }
+	var out []quest
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil { t.Fatal(err) }
+	var ids []string
+	for _, q := range out { ids = append(ids, q.ID) }
+	//open quests by name, then the done ones
+	if len(ids) != 3 || ids[0] != "T3" || ids[1] != "T1" || ids[2] != "T2" { t.Errorf("quest order = %v", ids) }
+	if out[2].CompletedBy == nil || *out[2].CompletedBy != "U1" { t.Errorf("completed quest = %+v", out[2]) }
+}
+
+func TestLogoutHandler(t *testing.T) {
+	h, s, m := newMemTestServer(t)
+	logout := func(origin string) *httptest.ResponseRecorder {
+		r := withSession(s, httptest.NewRequest("POST", "http://quests.example/api/auth/logout", nil), "sid-U1")
+		if origin != "" { r.Header.Set("Origin", origin) }
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+	live := func() bool {
+		_, err := m.SessionUser(context.Background(), "sid-U1")
+		return err == nil
+	}
+
+	if rec := logout("https://evil.example"); rec.Code != 403 || !live() { t.Errorf("cross-site logout: %d, session live %v", rec.Code, live()) }
+
+	rec := logout("http://quests.example")
+	if rec.Code != 204 || live() { t.Fatalf("logout: %d, session live %v", rec.Code, live()) }
+	cleared := false
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == s.sessionCookieName() && c.MaxAge < 0 { cleared = true }
+	}
+	if !cleared { t.Errorf("logout didn't clear the cookie: %v", rec.Header()["Set-Cookie"]) }
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, withSession(s, httptest.NewRequest("GET", "/api/me", nil), "sid-U1"))
+	if rec.Code != 401 { t.Errorf("me after logout: %d", rec.Code) }
+
+	//without a session there is nothing to clear
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/auth/logout", nil))
+	if rec.Code != 204 || len(rec.Result().Cookies()) != 0 { t.Errorf("anonymous logout: %d %v", rec.Code, rec.Result().Cookies()) }
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+//UserStore, SessionStore and QuestStore over the tables from
+//ensureAuthTables and ensureScoringTables. the sql sticks to what postgres
+//and sqlite both accept, so one store serves either
+type sqlStore struct {
+	db *sql.DB
+}
+
+var (
+	_ UserStore    = (*sqlStore)(nil)
+	_ SessionStore = (*sqlStore)(nil)
+	_ QuestStore   = (*sqlStore)(nil)
+)
+
+func newSQLStore(db *sql.DB) *sqlStore { return &sqlStore{db: db} }
+
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) { return errNotFound }
+	return err
+}
+
+func (p *sqlStore) UpsertUser(ctx context.Context, u userRow) error {
+	avatar := ""
+	if u.AvatarURL != nil { avatar = *u.AvatarURL }
+	_, err := p.db.ExecContext(ctx, `insert into users(id, name, avatar_url)
+		values($1,$2,nullif($3,''))
+		on conflict (id) do update set name=excluded.name,
+		avatar_url=coalesce(excluded.avatar_url, users.avatar_url)`,
+		u.ID, u.Name, avatar)
+	return err
+}
+
+func (p *sqlStore) GetUser(ctx context.Context, id string) (*userRow, error) {
+	var u userRow
+	err := p.db.QueryRowContext(ctx, `select id, name, avatar_url from users where id=$1`, id).
+		Scan(&u.ID, &u.Name, &u.AvatarURL)
+	if err != nil { return nil, notFound(err) }
+	return &u, nil
+}
+
+func (p *sqlStore) SaveAsanaTokens(ctx context.Context, t *asanaTokens) error {
+	_, err := p.db.ExecContext(ctx, `
+		insert into oauth_accounts(user_id, provider, access_token, refresh_token, scope, expires_at)
+		values($1,'asana',$2,$3,$4,$5)
+		on conflict (user_id, provider) do update set
+		  access_token=excluded.access_token,
+		  refresh_token=excluded.refresh_token,
+		  scope=excluded.scope,
+		  expires_at=excluded.expires_at`,
+		t.UserID, t.AccessToken, t.RefreshToken, t.Scope, t.ExpiresAt)
+	return err
+}
+
+func (p *sqlStore) AsanaTokens(ctx context.Context, userID string) (*asanaTokens, error) {
+	t := asanaTokens{UserID: userID}
+	var expires *time.Time
+	err := p.db.QueryRowContext(ctx, `
+		select access_token, coalesce(refresh_token,''), expires_at, coalesce(scope,'')
+		from oauth_accounts
+		where user_id=$1 and provider='asana'`, userID).Scan(&t.AccessToken, &t.RefreshToken, &expires, &t.Scope)
+	if err != nil { return nil, notFound(err) }
+	//no expiry on file means refresh right away
+	t.ExpiresAt = time.Now()
+	if expires != nil { t.ExpiresAt = *expires }
+	return &t, nil
+}
+
+func (p *sqlStore) SavePending(ctx context.Context, sid, state, verifier string) error {
+	_, err := p.db.ExecContext(ctx, `insert into sessions_meta(id, state, code_verifier) values($1,$2,$3)
+		on conflict (id) do update set state=excluded.state, code_verifier=excluded.code_verifier`, sid, state, verifier)
+	return err
+}
+
+func (p *sqlStore) Pending(ctx context.Context, sid string) (string, string, error) {
+	var state, verifier string
+	err := p.db.QueryRowContext(ctx, `select state, code_verifier from sessions_meta where id=$1`, sid).Scan(&state, &verifier)
+	return state, verifier, notFound(err)
+}
+
+func (p *sqlStore) ClearPending(ctx context.Context, sid string) error {
+	_, err := p.db.ExecContext(ctx, `delete from sessions_meta where id=$1`, sid)
+	return err
+}
+
+func (p *sqlStore) CreateSession(ctx context.Context, sid, userID string) error {
+	_, err := p.db.ExecContext(ctx, `insert into sessions(id, user_id) values($1,$2)
+		on conflict (id) do update set user_id=excluded.user_id`, sid, userID)
+	return err
+}
+
+func (p *sqlStore) SessionUser(ctx context.Context, sid string) (string, error) {
+	var userID string
+	err := p.db.QueryRowContext(ctx, `select user_id from sessions where id=$1`, sid).Scan(&userID)
+	return userID, notFound(err)
+}
+
+func (p *sqlStore) DeleteSession(ctx context.Context, sid string) error {
+	_, err := p.db.ExecContext(ctx, `delete from sessions where id=$1`, sid)
+	return err
+}
+
+const questCols = `id, name, difficulty, completed, completed_by, assignee_id, coalesce(state,'')`
+
+func scanQuest(row interface{ Scan(...any) error }) (*quest, error) {
+	var q quest
+	err := row.Scan(&q.ID, &q.Name, &q.Difficulty, &q.Completed, &q.CompletedBy, &q.AssigneeID, &q.State)
+	if err != nil { return nil, err }
+	return &q, nil
+}
+
+func (p *sqlStore) ListQuests(ctx context.Context, limit int) ([]quest, error) {
+	rows, err := p.db.QueryContext(ctx, `select `+questCols+`
+		from quests
+		order by completed asc, name asc
+		limit $1`, limit)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	var out []quest
+	for rows.Next() {
+		q, err := scanQuest(rows)
+		if err != nil { return nil, err }
+		out = append(out, *q)
+	}
+	return out, rows.Err()
+}
+
+func (p *sqlStore) GetQuest(ctx context.Context, id string) (*quest, error) {
+	q, err := scanQuest(p.db.QueryRowContext(ctx, `select `+questCols+` from quests where id=$1`, id))
+	if err != nil { return nil, notFound(err) }
+	return q, nil
+}
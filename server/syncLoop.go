@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+//keeps the configured project current with the service identity, so the
+//board moves even when nobody logs in. runs as a job: stop ends the loop
+//between runs, a run in flight finishes on ctx like any other job.
+//with webhooks a delivery starts a run right away, and every polled run
+//checks the webhook is still there
+func (s *server) syncLoop(stop, ctx context.Context) {
+	if _, err := s.serviceTokens(ctx); err != nil {
+		slog.Info("background sync off", "reason", err.Error())
+		return
+	}
+	slog.Info("background sync on", "project", s.cfg.AsanaProjectID, "interval", s.cfg.SyncInterval.String(),
+		"webhooks", s.cfg.AsanaWebhooks)
+
+	tick := time.NewTicker(s.cfg.SyncInterval)
+	defer tick.Stop()
+	kicked := false
+	for {
+		rctx := withRequestID(ctx, "sync-"+randomString(6))
+		if err := s.syncService(rctx); err != nil && ctx.Err() == nil {
+			logFrom(rctx).Warn("background sync failed", "err", err)
+		}
+		if s.cfg.AsanaWebhooks && !kicked { tick.Reset(s.pollInterval(rctx)) }
+		select {
+		case <-stop.Done():
+			return
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			kicked = false
+		case <-s.syncKick:
+			kicked = true
+		}
+	}
+}
+
+//SYNC_INTERVAL, or half of SYNC_STALE_AFTER while a webhook brings changes in
+//and polling only catches what it missed
+func (s *server) pollInterval(ctx context.Context) time.Duration {
+	t, err := s.serviceTokens(ctx)
+	if err == nil { err = s.ensureWebhook(ctx, t, s.cfg.AsanaProjectID) }
+	if err != nil {
+		if ctx.Err() == nil { logFrom(ctx).Warn("asana webhook unavailable, polling", "err", err) }
+		return s.cfg.SyncInterval
+	}
+	return max(s.cfg.SyncInterval, s.cfg.SyncStaleAfter/2)
+}
+
+//one sync of the configured project as the service identity, then rescores
+//whoever newly completed a quest
+func (s *server) syncService(ctx context.Context) error {
+	t, err := s.serviceTokens(ctx)
+	if err != nil { return err }
+	completers, err := s.syncProject(ctx, t, s.cfg.AsanaProjectID)
+	if err != nil { return err }
+	for _, uid := range completers {
+		if err := s.rescoreUser(uid); err != nil { return err }
+	}
+	return nil
+}
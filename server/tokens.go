@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//what an api token may do. cookie sessions can do everything but admin,
+//which is reserved for ADMIN_USER_IDS
+const (
+	scopeReadLeaderboard = "read:leaderboard"
+	scopeWriteKudos      = "write:kudos"
+	scopeAdmin           = "admin"
+)
+
+var knownScopes = []string{scopeReadLeaderboard, scopeWriteKudos, scopeAdmin}
+
+//prefix makes leaked tokens easy to grep for
+const tokenPrefix = "qb_"
+
+//who is calling, from a bearer token or the sid cookie
+type principal struct {
+	userID   string
+	admin    bool
+	viaToken bool
+	scopes   []string
+}
+
+//admin tokens implicitly carry every other scope
+func (p *principal) can(scope string) bool {
+	if !p.viaToken { return scope != scopeAdmin || p.admin }
+	if slices.Contains(p.scopes, scopeAdmin) { return p.admin }
+	return slices.Contains(p.scopes, scope)
+}
+
+type apiToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func ensureTokenTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+		  id TEXT PRIMARY KEY,
+		  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		  name TEXT NOT NULL,
+		  token_hash TEXT NOT NULL UNIQUE,
+		  scopes TEXT[] NOT NULL,
+		  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		  last_used_at TIMESTAMPTZ,
+		  revoked_at TIMESTAMPTZ
+		);
+	`)
+	return err
+}
+
+//scopes hold the same {a,b} array literal pq.Array writes to postgres
+func ensureTokenTablesSQLite(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+		  id TEXT PRIMARY KEY,
+		  user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		  name TEXT NOT NULL,
+		  token_hash TEXT NOT NULL UNIQUE,
+		  scopes TEXT NOT NULL,
+		  created_at TIMESTAMP NOT NULL DEFAULT `+sqliteNow+`,
+		  last_used_at TIMESTAMP,
+		  revoked_at TIMESTAMP
+		);
+	`)
+	return err
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *server) isAdmin(userID string) bool {
+	return slices.Contains(s.cfg.AdminUserIDs, userID)
+}
+
+//a request with an Authorization header is judged on that header alone and
+//never falls back to the cookie, so bearer requests carry no ambient credentials
+func (s *server) authenticate(r *http.Request) (*principal, error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		raw, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok || !strings.HasPrefix(raw, tokenPrefix) { return nil, errors.New("bad authorization header") }
+		p := &principal{viaToken: true}
+		var id string
+		err := s.db.QueryRow(`
+			select id, user_id, scopes from api_tokens
+			where token_hash=$1 and revoked_at is null`, hashToken(raw)).Scan(&id, &p.userID, pq.Array(&p.scopes))
+		if err != nil { return nil, errors.New("invalid token") }
+		_, _ = s.db.Exec(`update api_tokens set last_used_at=$2 where id=$1`, id, time.Now())
+		p.admin = s.isAdmin(p.userID)
+		return p, nil
+	}
+	uid, err := s.sessionUserID(r)
+	if err != nil { return nil, err }
+	return &principal{userID: uid, admin: s.isAdmin(uid)}, nil
+}
+
+//authenticates and checks scope, writes the 401/403 itself
+func (s *server) requireScope(w http.ResponseWriter, r *http.Request, scope string) (string, bool) {
+	p, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if !p.can(scope) {
+		http.Error(w, "missing scope "+scope, http.StatusForbidden)
+		return "", false
+	}
+	return p.userID, true
+}
+
+func (s *server) mountTokens(mux *http.ServeMux) {
+	mux.HandleFunc("GET /tokens", s.handleListTokens)
+	mux.HandleFunc("POST /tokens", s.handleCreateToken)
+	mux.HandleFunc("POST /tokens/{id}/revoke", s.handleRevokeToken)
+}
+
+//GET /tokens
+//token management needs a real browser session, tokens can't mint tokens
+func (s *server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionUserID(r)
+	if err != nil { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+
+	rows, err := s.db.Query(`
+		select id, name, scopes, created_at, last_used_at, revoked_at
+		from api_tokens where user_id=$1
+		order by created_at desc`, userID)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	defer rows.Close()
+
+	out := []apiToken{}
+	for rows.Next() {
+		var t apiToken
+		if err := rows.Scan(&t.ID, &t.Name, pq.Array(&t.Scopes), &t.CreatedAt, &t.LastUsedAt, &t.RevokedAt); err != nil {
+			http.Error(w, err.Error(), 500); return
+		}
+		out = append(out, t)
+	}
+	writeJSON(w, out)
+}
+
+//POST /tokens {"name":"ci bot","scopes":["read:leaderboard"]}
+//the raw token is only ever in this response
+func (s *server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionUserID(r)
+	if err != nil { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+
+	var body struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, "bad json", 400); return }
+	if body.Name = strings.TrimSpace(body.Name); body.Name == "" { http.Error(w, "name is required", 400); return }
+	if len(body.Scopes) == 0 { http.Error(w, "at least one scope is required", 400); return }
+	for _, sc := range body.Scopes {
+		if !slices.Contains(knownScopes, sc) { http.Error(w, "unknown scope "+sc, 400); return }
+		if sc == scopeAdmin && !s.isAdmin(userID) { http.Error(w, "only admins can issue admin tokens", 403); return }
+	}
+
+	raw := tokenPrefix + randomString(32)
+	t := apiToken{ID: randomString(9), Name: body.Name, Scopes: body.Scopes}
+	err = s.db.QueryRow(`insert into api_tokens(id, user_id, name, token_hash, scopes)
+		values($1,$2,$3,$4,$5) returning created_at`,
+		t.ID, userID, t.Name, hashToken(raw), pq.Array(t.Scopes)).Scan(&t.CreatedAt)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]any{"token": raw, "info": t})
+}
+
+//POST /tokens/{id}/revoke
+func (s *server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionUserID(r)
+	if err != nil { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+
+	res, err := s.db.Exec(`update api_tokens set revoked_at=$3
+		where id=$1 and user_id=$2 and revoked_at is null`, r.PathValue("id"), userID, time.Now())
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "not found", 404); return }
+	w.WriteHeader(http.StatusNoContent)
+}
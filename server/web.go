@@ -0,0 +1,72 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//the adapter-static build of ../frontend, `npm run build` writes it to web/build.
+//all: keeps web/.gitkeep in so a checkout without a build still compiles
+//
+//go:embed all:web
+var webFiles embed.FS
+
+func webBuild() fs.FS {
+	sub, _ := fs.Sub(webFiles, "web/build")
+	return sub
+}
+
+//everything that isn't the api or an ops endpoint is the frontend
+func (s *server) mountWeb(mux *http.ServeMux) {
+	mux.Handle("/", spaHandler(webBuild()))
+}
+
+//files from the build as they are, any other extensionless path gets index.html
+//so client side routes survive a reload. hashed assets under _app/immutable are
+//cached for good, everything else revalidates so a deploy shows up right away
+func spaHandler(fsys fs.FS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" { name = "index.html" }
+
+		if st, err := fs.Stat(fsys, name); err != nil || st.IsDir() {
+			//a missing script or image is a 404, not the app shell
+			if path.Ext(name) != "" { http.NotFound(w, r); return }
+			name = "index.html"
+			if _, err := fs.Stat(fsys, name); err != nil {
+				http.Error(w, "frontend not built, run npm run build in frontend", http.StatusNotFound)
+				return
+			}
+		}
+
+		if strings.HasPrefix(name, "_app/immutable/") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		http.ServeFileFS(w, r, fsys, name)
+	})
+}
+
+//serves api under /api with the prefix stripped. the inner pattern is copied
+//back so metrics and request logs keep labelling by route, not by "/api/"
+func apiPrefix(api http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner := new(http.Request)
+		*inner = *r
+		u := *r.URL
+		u.Path = strings.TrimPrefix(r.URL.Path, "/api")
+		u.RawPath = strings.TrimPrefix(r.URL.RawPath, "/api")
+		inner.URL = &u
+		api.ServeHTTP(w, inner)
+		r.Pattern = inner.Pattern
+	})
+}
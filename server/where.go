@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+//optional filters for a query. postgres can't type a bare `$1 is null`
+//and sqlite has no casts, so only the filters in use end up in the sql
+type whereClause struct {
+	conds []string
+	args  []any
+}
+
+//cond marks its one argument with ?
+func (wc *whereClause) add(cond string, arg any) {
+	wc.conds = append(wc.conds, strings.Replace(cond, "?", wc.arg(arg), 1))
+}
+
+//adds an argument that isn't a filter, like a limit, and returns its $n
+func (wc *whereClause) arg(v any) string {
+	wc.args = append(wc.args, v)
+	return "$" + strconv.Itoa(len(wc.args))
+}
+
+//"where ..." with the filters anded, "where true" without any so callers
+//can always go on with "and ..."
+func (wc whereClause) sql() string {
+	if len(wc.conds) == 0 { return "where true" }
+	return "where " + strings.Join(wc.conds, " and ")
+}
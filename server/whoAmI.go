@@ -1,9 +1,9 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"encoding/json"
-	"fmt"
 )
 
 func (s *server) mountMe(mux *http.ServeMux) {
@@ -11,49 +11,42 @@ func (s *server) mountMe(mux *http.ServeMux) {
 }
 
 func (s *server) handleMe(w http.ResponseWriter, r *http.Request) {
-	sid := getSessionCookie(r)
-	fmt.Println("SID:", sid)
-
+	sid := s.getSessionCookie(r)
 	if sid == "" {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		fmt.Println("SID empty")
 		return
 	}
-	var userID, name string
-	err := s.db.QueryRow(`
-		select u.id, u.name
-		from sessions s
-		join users u on u.id = s.user_id
-		where s.id=$1`, sid).Scan(&userID, &name)
+	userID, err := s.sessions.SessionUser(r.Context(), sid)
+	var u *userRow
+	if err == nil { u, err = s.users.GetUser(r.Context(), userID) }
 	if err != nil {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
-		fmt.Println("our error is: ", err)
+		if !errors.Is(err, errNotFound) { logFrom(r.Context()).Error("me lookup failed", "err", err) }
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]any{
-		"user_id": userID,
-		"name":    name,
+		"user_id": u.ID,
+		"name":    u.Name,
 	})
 }
 
+//user id behind the sid cookie, errors when there is no live session
+func (s *server) sessionUserID(r *http.Request) (string, error) {
+	sid := s.getSessionCookie(r)
+	if sid == "" { return "", errors.New("no session") }
+	return s.sessions.SessionUser(r.Context(), sid)
+}
+
 func (s *server) mountLogout(mux *http.ServeMux) {
 	mux.HandleFunc("POST /auth/logout", s.handleLogout)
-	fmt.Println("Logout mounted")
 }
 
 func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	sid := getSessionCookie(r)
+	sid := s.getSessionCookie(r)
 	if sid != "" {
-		_, _ = s.db.Exec(`delete from sessions where id=$1`, sid)
-		http.SetCookie(w, &http.Cookie{
-			Name:     "sid",
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-		})
+		_ = s.sessions.DeleteSession(r.Context(), sid)
+		s.clearSessionCookie(w)
 	}
 	w.WriteHeader(http.StatusNoContent)
 }